@@ -31,16 +31,38 @@ type (
         // all received message from connection will forward to this channel
         RawMessageChannelSetter
 
+        // unique id of connection
+        Id() uint64
+
+        // key/value data attached to connection
+        Session() Session
+
+        // replace session, used for restoring session after reconnect
+        SetSession(s Session)
+
         // start reading data from connection
         Start() error
 
-        // close the connection
+        // close the connection, calling Close more than once is allowed
         Close() error
 
+        // returns a channel that's closed when the connection is closed
+        Done() <-chan struct{}
+
         // write bytes to connection
         Write([]byte) (int, error)
     }
 
+    // connection writes bytes in background
+    AsyncWriter interface {
+        // process bytes with all output filters, then write in background
+        Enqueue(b []byte) error
+
+        // bytes already processed by shared output filters, process with per-connection filters then write,
+        // bytes will not be modified, so they can be shared by many connections
+        EnqueuePrepared(b []byte) error
+    }
+
     ConnectionGroup interface {
         // set handler function for incoming rawMessage
         RawMessageReceiverSetter
@@ -51,22 +73,72 @@ type (
         // close all connections in group
         Close() error
 
-        // add connection to group
+        // add connection to group, messages from connection will be handled by this group,
+        // so connection can be added to only one group, use Topic for broadcasting to many groups
         Add(c Connection) error
 
         // remove connection from group
         Remove(c Connection) error
 
+        // move connection to target group atomically, no message will be lost during moving,
+        // messages already queued in group are still handled by group before target handles newer messages,
+        // target must be running
+        MoveTo(c Connection, target ConnectionGroup) error
+
+        // set handler function called after connection joined group
+        OnJoin(f ConnectionEventFunc)
+
+        // set handler function called after connection left group
+        OnLeave(f ConnectionEventFunc)
+
+        // set handler function called after last connection left group
+        OnEmpty(f GroupEventFunc)
+
+        // returns a channel that's closed when the group is closed
+        Done() <-chan struct{}
+
         // get message channel for group
         RawMessageChan() chan RawMessage
 
         // write bytes to all connections in group
         BroadcastWrite([]byte)
+
+        // write bytes to all connections in group except specified connections
+        BroadcastWriteExcept(b []byte, exclude ...uint64)
+
+        // write bytes to the connection in group, returns ErrConnectionNotFound if connection has left
+        SendTo(id uint64, b []byte) error
+
+        // get connection in group by id, returns ErrConnectionNotFound if connection has left
+        Get(id uint64) (Connection, error)
+
+        // find connections in group
+        Find(predicate func(c Connection) bool) []Connection
+
+        // call f for each connection in group, stop if f returns false
+        Range(f func(c Connection) bool)
+
+        // number of connections in group
+        Len() int
+    }
+
+    ConnectionLocator interface {
+        // find connection by id, returns ErrConnectionNotFound if connection not exists or closed
+        Connection(id uint64) (Connection, error)
     }
 
     // when new connection accepted, call this function
     OnConnectFunc func(net.Conn) Connection
 
+    // when connection closed, call this function with the reason, reason is nil if closed by Close()
+    OnCloseFunc func(c Connection, reason error)
+
+    // when connection joined or left group, call this function
+    ConnectionEventFunc func(g ConnectionGroup, c Connection)
+
+    // when group state changed, call this function
+    GroupEventFunc func(g ConnectionGroup)
+
     ConnectionManager interface {
         // set handler function for incoming connect
         OnConnect(OnConnectFunc)
@@ -0,0 +1,56 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gbc
+
+import (
+    "errors"
+)
+
+var (
+    // returned when operate on a closing or closed connection
+    ErrConnectionClosed = errors.New("connection is closed")
+
+    // returned when connection not in group
+    ErrConnectionNotFound = errors.New("connection not found")
+
+    // returned when write queue of connection is full
+    ErrWriteQueueFull = errors.New("write queue is full")
+
+    // returned when session token not exists or expired
+    ErrSessionNotFound = errors.New("session not found")
+
+    // returned when connection closed for exceeding rate limit
+    ErrRateLimitExceeded = errors.New("rate limit exceeded")
+
+    // returned when message needs more tokens than burst of rate limit, so it can never pass
+    ErrRateLimitBurstExceeded = errors.New("message exceeds burst of rate limit")
+
+    // returned when too many messages are waiting for handler
+    ErrPendingMessagesFull = errors.New("pending messages are full")
+
+    // returned when message rejected by authorization check
+    ErrUnauthorized = errors.New("unauthorized")
+
+    // returned when reply of request not received in time
+    ErrRequestTimeout = errors.New("request timeout")
+)
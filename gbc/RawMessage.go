@@ -41,4 +41,11 @@ type (
     RawMessageChannelSetter interface {
         SetRawMessageChannel(chan RawMessage)
     }
+
+    // message knows which connection it comes from
+    ConnectionRawMessage interface {
+        RawMessage
+        Connection() Connection
+        SetConnection(c Connection)
+    }
 )
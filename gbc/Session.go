@@ -0,0 +1,59 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gbc
+
+type (
+    Session interface {
+        // client presents token to restore session after reconnect, token is issued by first calling
+        Token() string
+
+        // returns true if token has been issued, only these sessions can be restored
+        HasToken() bool
+
+        // get value by key, returns false if key not exists
+        Get(key string) (interface{}, bool)
+
+        // get typed value, returns false if key not exists or value type mismatched
+        GetString(key string) (string, bool)
+        GetInt(key string) (int64, bool)
+        GetFloat(key string) (float64, bool)
+        GetBool(key string) (bool, bool)
+
+        // set value for key
+        Set(key string, value interface{})
+
+        // delete key from session
+        Delete(key string)
+
+        // get all keys in session
+        Keys() []string
+    }
+
+    SessionStore interface {
+        // keep session for restoring later
+        Save(s Session) error
+
+        // take out the session by token
+        Restore(token string) (Session, error)
+    }
+)
@@ -0,0 +1,46 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gbc
+
+type (
+    // broadcast channel, a connection can subscribe to many topics
+    Topic interface {
+        // name of topic
+        Name() string
+
+        // subscribe connection, connection unsubscribes automatically after closed
+        Subscribe(c Connection) error
+
+        // unsubscribe connection
+        Unsubscribe(c Connection) error
+
+        // write bytes to all subscribers
+        Publish(b []byte)
+
+        // write bytes to all subscribers except specified connections
+        PublishExcept(b []byte, exclude ...uint64)
+
+        // number of subscribers
+        Len() int
+    }
+)
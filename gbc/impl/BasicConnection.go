@@ -1,6 +1,6 @@
 // MIT License
 //
-// Copyright (conn) 2018 dualface
+// Copyright (c) 2018 dualface
 //
 // Permission is hereby granted, free of charge, to any person obtaining a copy
 // of this software and associated documentation files (the "Software"), to deal
@@ -23,118 +23,675 @@
 package impl
 
 import (
+    "fmt"
     "io"
     "net"
+    "sync"
+    "sync/atomic"
+    "time"
 
     "github.com/dualface/go-cli-colorlog"
     "github.com/dualface/go-gbc/gbc"
 )
 
 const (
-    readBufferSize   = 1024 * 4 // 4KB
-    readFailureLimit = 3
+    DefaultReadBufferSize   = 1024 * 4 // 4KB
+    DefaultReadFailureLimit = 3
+    DefaultReadRetryDelay   = time.Millisecond * 10
+    DefaultWriteQueueSize   = 256
 )
 
+const (
+    ConnectionStateNew ConnectionState = iota
+    ConnectionStateStarted
+    ConnectionStateSuspended // link lost, waiting for resuming
+    ConnectionStateClosing
+    ConnectionStateClosed
+)
+
+var lastConnectionId uint64
+
 type (
+    ConnectionState int32
+
+    // returns true if reading can be retried after the error
+    ReadErrorClassifier func(err error) bool
+
+    // physical link of connection, replaced after resumed
+    connectionLink struct {
+        rawConn net.Conn
+        input   gbc.InputFilter
+        inbox   chan gbc.RawMessage
+        stopped chan struct{} // closed when no more message will be delivered
+        down    chan struct{} // closed when reading stopped
+    }
+
     BasicConnection struct {
-        RawConn      net.Conn
-        InputFilter  gbc.InputFilter
+        RawConn     net.Conn
+        InputFilter gbc.InputFilter
+        // stateless filter, runs once for all connections when broadcasting, must be same as group's
+        SharedOutputFilter gbc.OutputFilter
+        // per-connection filter, runs after shared filter
         OutputFilter gbc.OutputFilter
-        MessageChan  chan gbc.RawMessage
+
+        // size of each half of the double read buffer
+        ReadBufferSize int
+        // stop reading after continuous temporary failures
+        ReadFailureLimit int
+        // waiting before retry reading
+        ReadRetryDelay time.Duration
+        // classify read errors, permanent error stops reading immediately
+        IsTemporaryError ReadErrorClassifier
+        // limit inbound messages, nil means unlimited
+        RateLimiter *RateLimiter
+        // capacity of queue for Enqueue() and EnqueuePrepared()
+        WriteQueueSize int
+
+        id          uint64
+        session     gbc.Session
+        onCloseFunc gbc.OnCloseFunc
+        state       int32
+        link        *connectionLink
+        messageChan chan gbc.RawMessage
+        rebind      chan struct{} // closed when messageChan changed
+        writeQueue  chan []byte
+        done        chan struct{}
+        mutex       *sync.Mutex
+        writeMutex  *sync.Mutex
+
+        // session resuming, see SessionResumer
+        replay      *ReplayBuffer
+        resumeGrace time.Duration
+        graceTimer  *time.Timer
+        controlFunc func(c *BasicConnection, m gbc.RawMessage) bool
+        sessionFunc func(c *BasicConnection, s gbc.Session) // called after session replaced
     }
 )
 
 func NewBasicConnection(rawConn net.Conn, i gbc.InputFilter) *BasicConnection {
     conn := &BasicConnection{
-        RawConn:     rawConn,
-        InputFilter: i,
+        RawConn:          rawConn,
+        InputFilter:      i,
+        ReadBufferSize:   DefaultReadBufferSize,
+        ReadFailureLimit: DefaultReadFailureLimit,
+        ReadRetryDelay:   DefaultReadRetryDelay,
+        IsTemporaryError: IsTemporaryReadError,
+        WriteQueueSize:   DefaultWriteQueueSize,
+        id:               atomic.AddUint64(&lastConnectionId, 1),
+        session:          NewBasicSession(),
+        state:            int32(ConnectionStateNew),
+        rebind:           make(chan struct{}),
+        done:             make(chan struct{}),
+        mutex:            &sync.Mutex{},
+        writeMutex:       &sync.Mutex{},
     }
     return conn
 }
 
+// default ReadErrorClassifier, only timeout and temporary net errors can be retried
+func IsTemporaryReadError(err error) bool {
+    ne, ok := err.(net.Error)
+    return ok && (ne.Timeout() || ne.Temporary())
+}
+
+func (s ConnectionState) String() string {
+    switch s {
+    case ConnectionStateNew:
+        return "new"
+    case ConnectionStateStarted:
+        return "started"
+    case ConnectionStateSuspended:
+        return "suspended"
+    case ConnectionStateClosing:
+        return "closing"
+    case ConnectionStateClosed:
+        return "closed"
+    default:
+        return fmt.Sprintf("unknown(%d)", int32(s))
+    }
+}
+
 // interface Connection
 
+func (c *BasicConnection) Id() uint64 {
+    return c.id
+}
+
+func (c *BasicConnection) Session() gbc.Session {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    return c.session
+}
+
+func (c *BasicConnection) SetSession(s gbc.Session) {
+    c.mutex.Lock()
+    c.session = s
+    f := c.sessionFunc
+    c.mutex.Unlock()
+
+    if f != nil {
+        f(c, s)
+    }
+}
+
 func (c *BasicConnection) Start() error {
+    queueSize := c.WriteQueueSize
+    if queueSize < 1 {
+        queueSize = DefaultWriteQueueSize
+    }
+
+    // hold mutex, so Close() always sees the link of started connection
+    c.mutex.Lock()
+    if !c.transit(ConnectionStateNew, ConnectionStateStarted) {
+        c.mutex.Unlock()
+        return fmt.Errorf("connection '%s' can't start, state is %s", c.RawConn.RemoteAddr().String(), c.State())
+    }
+    link := c.newLink()
+    c.link = link
+    c.writeQueue = make(chan []byte, queueSize)
+    c.mutex.Unlock()
+
     if c.InputFilter == nil {
         clog.PrintWarn("connection '%s' not set input filter", c.RawConn.RemoteAddr().String())
-    } else {
-        c.InputFilter.SetRawMessageChannel(c.MessageChan)
     }
 
-    if c.MessageChan == nil {
+    if mc, _ := c.rawMessageChannel(); mc == nil {
         clog.PrintWarn("connection '%s' not set raw message chan", c.RawConn.RemoteAddr().String())
     }
 
-    go c.loop()
+    go c.loop(link)
+    go c.forward(link)
+    go c.writeLoop(c.writeQueue)
+
+    if c.replay != nil {
+        // client presents token to resume session after reconnect
+        c.writeControl(newResumeControlMessage(ResumeTokenSubCmdId, 0, c.Session().Token()))
+    }
     return nil
 }
 
 func (c *BasicConnection) Close() error {
-    c.InputFilter = nil
-    c.OutputFilter = nil
-    c.MessageChan = nil
-    return c.RawConn.Close()
+    return c.closeWithReason(nil)
+}
+
+func (c *BasicConnection) Done() <-chan struct{} {
+    return c.done
+}
+
+func (c *BasicConnection) Write(b []byte) (int, error) {
+    p, err := c.prepare(b)
+    if err != nil {
+        return 0, err
+    }
+
+    _, err = c.writePrepared(p)
+    if err != nil {
+        return 0, err
+    }
+    return len(b), nil
+}
+
+func (c *BasicConnection) SetRawMessageChannel(mc chan gbc.RawMessage) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    c.messageChan = mc
+    close(c.rebind)
+    c.rebind = make(chan struct{})
+}
+
+// interface AsyncWriter
+
+func (c *BasicConnection) Enqueue(b []byte) error {
+    p, err := c.prepare(b)
+    if err != nil {
+        return err
+    }
+    return c.EnqueuePrepared(p)
 }
 
-func (c *BasicConnection) Write(b []byte) (writeLen int, err error) {
-    var output []byte
+func (c *BasicConnection) EnqueuePrepared(b []byte) error {
+    c.mutex.Lock()
+    queue := c.writeQueue
+    c.mutex.Unlock()
+
+    if queue == nil || c.isClosing() {
+        return gbc.ErrConnectionClosed
+    }
+
+    select {
+    case queue <- b:
+        return nil
+    default:
+        return gbc.ErrWriteQueueFull
+    }
+}
+
+// public
+
+func (c *BasicConnection) State() ConnectionState {
+    return ConnectionState(atomic.LoadInt32(&c.state))
+}
+
+// set handler function called once after connection closed, must be set before Start()
+func (c *BasicConnection) OnClose(f gbc.OnCloseFunc) {
+    c.onCloseFunc = f
+}
+
+// private
+
+func (c *BasicConnection) transit(from ConnectionState, to ConnectionState) bool {
+    return atomic.CompareAndSwapInt32(&c.state, int32(from), int32(to))
+}
+
+func (c *BasicConnection) closeWithReason(reason error) error {
+    for {
+        state := c.State()
+        if state != ConnectionStateNew && state != ConnectionStateStarted && state != ConnectionStateSuspended {
+            // already closing or closed
+            return nil
+        }
+        if !c.transit(state, ConnectionStateClosing) {
+            continue
+        }
+
+        close(c.done)
+
+        c.mutex.Lock()
+        link := c.link
+        if c.graceTimer != nil {
+            c.graceTimer.Stop()
+            c.graceTimer = nil
+        }
+        c.mutex.Unlock()
+
+        var err error
+        switch state {
+        case ConnectionStateNew:
+            err = c.RawConn.Close()
+        case ConnectionStateStarted:
+            err = link.rawConn.Close()
+            // waiting for the message being forwarded
+            <-link.stopped
+        }
+        atomic.StoreInt32(&c.state, int32(ConnectionStateClosed))
+
+        if c.onCloseFunc != nil {
+            c.onCloseFunc(c, reason)
+        }
+        return err
+    }
+}
+
+func (c *BasicConnection) isClosing() bool {
+    select {
+    case <-c.done:
+        return true
+    default:
+        return false
+    }
+}
+
+func (c *BasicConnection) rawMessageChannel() (chan gbc.RawMessage, chan struct{}) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    return c.messageChan, c.rebind
+}
+
+// must hold mutex
+func (c *BasicConnection) newLink() *connectionLink {
+    link := &connectionLink{
+        rawConn: c.RawConn,
+        input:   c.InputFilter,
+        inbox:   make(chan gbc.RawMessage),
+        stopped: make(chan struct{}),
+        down:    make(chan struct{}),
+    }
+    if link.input != nil {
+        // messages fetched by input filter are forwarded by connection,
+        // so they can be dropped after connection closed
+        link.input.SetRawMessageChannel(link.inbox)
+    }
+    return link
+}
+
+// process bytes with shared output filter, returns new bytes
+func (c *BasicConnection) prepare(b []byte) ([]byte, error) {
+    // filters may change bytes in place
+    p := append([]byte(nil), b...)
+    if c.SharedOutputFilter == nil {
+        return p, nil
+    }
+    return c.SharedOutputFilter.WriteBytes(p)
+}
+
+func (c *BasicConnection) writePrepared(p []byte) (int, error) {
+    // output filter may keep state, so write bytes one by one
+    c.writeMutex.Lock()
+    defer c.writeMutex.Unlock()
+
+    state := c.State()
+    if state != ConnectionStateStarted && state != ConnectionStateSuspended {
+        return 0, gbc.ErrConnectionClosed
+    }
+
+    if c.replay != nil {
+        // prepared bytes are never modified, keep them for replaying
+        c.replay.Push(p)
+        if state == ConnectionStateSuspended {
+            // will be sent after resumed
+            return len(p), nil
+        }
+    }
+    return c.writeBytes(p)
+}
+
+// must hold writeMutex
+func (c *BasicConnection) writeBytes(p []byte) (writeLen int, err error) {
+    output := p
     if c.OutputFilter != nil {
-        output, err = c.OutputFilter.WriteBytes(b)
+        // prepared bytes may be shared with other connections
+        output, err = c.OutputFilter.WriteBytes(append([]byte(nil), p...))
         if err != nil {
             return
         }
-        writeLen, err = c.RawConn.Write(output)
     }
-    return
+    return c.RawConn.Write(output)
 }
 
-func (c *BasicConnection) SetRawMessageChannel(mc chan gbc.RawMessage) {
-    c.MessageChan = mc
-    if c.InputFilter != nil {
-        c.InputFilter.SetRawMessageChannel(mc)
+// write bytes not counted in replay sequence
+func (c *BasicConnection) writeControl(b []byte) error {
+    p, err := c.prepare(b)
+    if err != nil {
+        return err
+    }
+
+    c.writeMutex.Lock()
+    defer c.writeMutex.Unlock()
+
+    if c.State() != ConnectionStateStarted {
+        return gbc.ErrConnectionClosed
     }
+    _, err = c.writeBytes(p)
+    return err
 }
 
-// private
+func (c *BasicConnection) writeLoop(queue chan []byte) {
+    for {
+        select {
+        case p := <-queue:
+            _, err := c.writePrepared(p)
+            if err != nil && err != gbc.ErrConnectionClosed {
+                clog.PrintWarn("writing failed on connection %d, %s", c.id, err)
+            }
+
+        case <-c.done:
+            return
+        }
+    }
+}
+
+func (c *BasicConnection) loop(link *connectionLink) {
+    defer close(link.down)
+
+    reason := c.read(link)
+    // forwarder exits after inbox closed, then connection can be closed
+    close(link.inbox)
+    <-link.stopped
+
+    if c.replay != nil && !c.isClosing() {
+        c.suspend(link, reason)
+        return
+    }
+    c.closeWithReason(reason)
+}
+
+// read bytes until link closed, returns the reason
+func (c *BasicConnection) read(link *connectionLink) error {
+    halfBufSize := c.ReadBufferSize
+    if halfBufSize <= 0 {
+        halfBufSize = DefaultReadBufferSize
+    }
+    failureLimit := c.ReadFailureLimit
+    if failureLimit <= 0 {
+        failureLimit = DefaultReadFailureLimit
+    }
+    isTemporary := c.IsTemporaryError
+    if isTemporary == nil {
+        isTemporary = IsTemporaryReadError
+    }
 
-func (c *BasicConnection) loop() {
     failure := 0
-    // use double buffer
-    halfBufSize := readBufferSize
+    // use double buffer, input filter may still refer the bytes of last reading
     buf := make([]byte, halfBufSize*2, halfBufSize*2)
     offset := 0
 
     for {
-        if failure >= readFailureLimit {
-            // stop read
-            break
-        }
+        avail, err := link.rawConn.Read(buf[offset : offset+halfBufSize])
+        if avail > 0 && link.input != nil {
+            _, ferr := link.input.WriteBytes(buf[offset : offset+avail])
+            if ferr != nil {
+                clog.PrintWarn("parsing bytes failed, %s", ferr)
+            }
 
-        avail, err := c.RawConn.Read(buf[offset : offset+halfBufSize])
-        if err != nil {
-            if err != io.EOF {
-                clog.PrintWarn("reading failed on %s, %s", c.RawConn.RemoteAddr(), err)
-                failure++
-                continue // try again
-            } else if avail == 0 {
-                break // conn closed
+            offset += avail
+            if offset >= halfBufSize {
+                offset = 0
             }
-        } else {
+        }
+
+        if err == nil {
             // reset read failure counter
             failure = 0
+            continue
         }
 
-        if avail > 0 && c.InputFilter != nil {
-            _, err := c.InputFilter.WriteBytes(buf[offset : offset+avail])
-            if err != nil {
-                clog.PrintWarn("parsing bytes failed, %s", err)
-            }
+        if c.isClosing() {
+            return nil // conn closed by Close()
+        }
+        if err == io.EOF {
+            return err // conn closed by remote
+        }
+        if !isTemporary(err) {
+            clog.PrintWarn("reading failed on %s, %s", link.rawConn.RemoteAddr(), err)
+            return err
+        }
 
-            offset += avail
+        failure++
+        if failure >= failureLimit {
+            clog.PrintWarn("reading failed on %s %d times, %s", link.rawConn.RemoteAddr(), failure, err)
+            return err
+        }
+        if c.ReadRetryDelay > 0 {
+            time.Sleep(c.ReadRetryDelay)
+        }
+    }
+}
+
+func (c *BasicConnection) forward(link *connectionLink) {
+    defer close(link.stopped)
+
+    // keep draining inbox until loop exited, avoid blocking input filter
+    for m := range link.inbox {
+        if c.controlFunc != nil && c.controlFunc(c, m) {
+            continue
         }
+        if c.RateLimiter != nil && !c.limit(m) {
+            continue
+        }
+        c.deliver(m)
+    }
+}
+
+// returns false if message should be dropped
+func (c *BasicConnection) limit(m gbc.RawMessage) bool {
+    wait, v := c.RateLimiter.Allow(m)
+    if v != nil {
+        if f := c.RateLimiter.policy.OnViolation; f != nil {
+            // callback may close connection, Close() waits for forwarder
+            go f(c, *v)
+        }
+        if v.Err == gbc.ErrRateLimitBurstExceeded {
+            clog.PrintWarn("connection %d message of %d bytes rejected by %s limit, %s", c.id, len(m.DataBytes()), v.Limit, v.Err)
+        }
+    }
 
-        if offset >= halfBufSize {
-            offset = 0
+    if wait > 0 {
+        select {
+        case <-time.After(wait):
+            return true
+        case <-c.done:
+            return false
         }
     }
+    if v == nil {
+        return true
+    }
+
+    switch v.Action {
+    case RateLimitActionDrop:
+        return false
+    case RateLimitActionDisconnect:
+        // close in another goroutine, Close() waits for forwarder
+        go c.closeWithReason(v.Err)
+        return false
+    default:
+        return true
+    }
+}
+
+func (c *BasicConnection) deliver(m gbc.RawMessage) {
+    cm, ok := m.(gbc.ConnectionRawMessage)
+    if ok {
+        cm.SetConnection(c)
+    }
+
+    for {
+        if c.isClosing() {
+            // drop message after connection closed
+            return
+        }
+
+        mc, rebind := c.rawMessageChannel()
+        select {
+        case mc <- m:
+            return
+        case <-rebind:
+            // message channel changed, deliver to the new one
+        case <-c.done:
+            return
+        }
+    }
+}
+
+// keep connection and group membership after link lost, close it if not resumed in time
+func (c *BasicConnection) suspend(link *connectionLink, reason error) {
+    link.rawConn.Close()
+    if !c.transit(ConnectionStateStarted, ConnectionStateSuspended) {
+        return
+    }
+
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.graceTimer = time.AfterFunc(c.resumeGrace, func() {
+        c.closeWithReason(reason)
+    })
+}
+
+// check whether connection can be resumed from the sequence
+func (c *BasicConnection) canResume(lastSeq uint64) bool {
+    c.writeMutex.Lock()
+    defer c.writeMutex.Unlock()
+
+    if c.isClosing() || c.replay == nil {
+        return false
+    }
+    _, err := c.replay.Since(lastSeq)
+    return err == nil
+}
+
+// take over raw connection and filters of new link, then replay messages after lastSeq
+func (c *BasicConnection) resume(rawConn net.Conn, i gbc.InputFilter, o gbc.OutputFilter, lastSeq uint64) error {
+    if c.State() == ConnectionStateStarted {
+        // old link is half-open, drop it and waiting for suspended
+        c.mutex.Lock()
+        old := c.link
+        c.mutex.Unlock()
+
+        old.rawConn.Close()
+        select {
+        case <-old.down:
+        case <-time.After(resumeWaitTimeout):
+            return fmt.Errorf("connection %d not suspended in %s", c.id, resumeWaitTimeout)
+        }
+    }
+
+    c.writeMutex.Lock()
+    defer c.writeMutex.Unlock()
+
+    if c.State() != ConnectionStateSuspended {
+        return gbc.ErrConnectionClosed
+    }
+    pending, err := c.replay.Since(lastSeq)
+    if err != nil {
+        return err
+    }
+
+    c.mutex.Lock()
+    if c.graceTimer != nil {
+        c.graceTimer.Stop()
+        c.graceTimer = nil
+    }
+    c.RawConn = rawConn
+    c.InputFilter = i
+    c.OutputFilter = o
+    link := c.newLink()
+    c.link = link
+    c.mutex.Unlock()
+
+    if !c.transit(ConnectionStateSuspended, ConnectionStateStarted) {
+        return gbc.ErrConnectionClosed
+    }
+
+    go c.loop(link)
+    go c.forward(link)
+
+    p, err := c.prepare(newResumeControlMessage(ResumeAcceptedSubCmdId, lastSeq, c.Session().Token()))
+    if err == nil {
+        _, err = c.writeBytes(p)
+    }
+    for _, b := range pending {
+        if err != nil {
+            // loop will find the broken link
+            break
+        }
+        _, err = c.writeBytes(b)
+    }
+    return nil
+}
+
+// stop reading without closing raw connection, then close this connection
+func (c *BasicConnection) detach() (net.Conn, gbc.InputFilter, gbc.OutputFilter, error) {
+    if !c.transit(ConnectionStateStarted, ConnectionStateClosing) {
+        return nil, nil, nil, gbc.ErrConnectionClosed
+    }
+    close(c.done)
+
+    c.mutex.Lock()
+    link := c.link
+    c.mutex.Unlock()
+
+    // interrupt reading
+    link.rawConn.SetReadDeadline(time.Now())
+    <-link.down
+    link.rawConn.SetReadDeadline(time.Time{})
+
+    atomic.StoreInt32(&c.state, int32(ConnectionStateClosed))
+    if c.onCloseFunc != nil {
+        c.onCloseFunc(c, nil)
+    }
+
+    c.writeMutex.Lock()
+    defer c.writeMutex.Unlock()
+    return link.rawConn, link.input, c.OutputFilter, nil
 }
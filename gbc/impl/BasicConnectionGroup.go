@@ -23,9 +23,13 @@
 package impl
 
 import (
+    "context"
     "fmt"
     "sync"
+    "sync/atomic"
+    "time"
 
+    "github.com/dualface/go-cli-colorlog"
     "github.com/dualface/go-gbc/gbc"
 )
 
@@ -33,17 +37,56 @@ const (
     connectionPoolSize = 10000
 )
 
+var lastGroupId uint64
+
 type (
-    connectionsMap = map[gbc.Connection]bool
+    groupMember struct {
+        conn gbc.Connection
+        left chan struct{} // closed when connection left group
+    }
+
+    connectionsMap = map[uint64]*groupMember
+
+    // asks receiving goroutine to report when messages of connection received before are handled
+    groupFlush struct {
+        id      uint64
+        drained chan struct{}
+    }
 
     BasicConnectionGroup struct {
         Name string
-
+        // stateless filter for broadcasting, runs once for all connections,
+        // must be same as SharedOutputFilter of connections in group
+        OutputFilter gbc.OutputFilter
+        // close group after it's empty for a while, zero means never,
+        // timer starts after first connection added, so new group is not closed before used
+        IdleTimeout time.Duration
+        // capacity of each priority lane of message queue, zero means DefaultMessageQueueSize
+        QueueSize int
+        // what to do when message queue is full
+        OverflowPolicy OverflowPolicy
+        // choose lane for incoming message, nil means all messages are normal
+        PriorityFunc MessagePriorityFunc
+
+        id               uint64
         onRawMessageFunc gbc.OnRawMessageFunc
+        onJoinFunc       gbc.ConnectionEventFunc
+        onLeaveFunc      gbc.ConnectionEventFunc
+        onEmptyFunc      gbc.GroupEventFunc
         connections      connectionsMap
         messageChan      chan gbc.RawMessage
-        quit             chan int
+        flushChan        chan groupFlush
+        pending          map[uint64]int             // id of connection -> messages received but not handled
+        drainWaiters     map[uint64][]chan struct{} // id of connection -> waiting for pending messages handled
+        queue            *MessageQueue
+        cancel           context.CancelFunc
+        loopDone         chan struct{} // closed when loop exited
+        done             chan struct{}
+        idleTimer        *time.Timer
+        idleGen          int  // invalidate fired timer
+        joined           bool // ever had connection since started
         running          bool
+        closed           bool
         mutex            *sync.Mutex
     }
 
@@ -53,10 +96,14 @@ type (
 func NewBasicConnectionGroup(name string, messageFunc gbc.OnRawMessageFunc) *BasicConnectionGroup {
     g := &BasicConnectionGroup{
         Name:             name,
+        id:               atomic.AddUint64(&lastGroupId, 1),
         onRawMessageFunc: messageFunc,
         connections:      make(connectionsMap, connectionPoolSize),
         messageChan:      make(chan gbc.RawMessage),
-        quit:             make(chan int),
+        flushChan:        make(chan groupFlush),
+        pending:          make(map[uint64]int),
+        drainWaiters:     make(map[uint64][]chan struct{}),
+        done:             make(chan struct{}),
         running:          false,
         mutex:            &sync.Mutex{},
     }
@@ -67,104 +114,589 @@ func NewBasicConnectionGroup(name string, messageFunc gbc.OnRawMessageFunc) *Bas
 // interface ConnectionGroup
 
 func (g *BasicConnectionGroup) OnRawMessage(f gbc.OnRawMessageFunc) {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
     g.onRawMessageFunc = f
 }
 
 func (g *BasicConnectionGroup) Start() error {
-    if g.running {
-        return fmt.Errorf("connection '%s' group is already running", g.Name)
-    }
-
-    g.running = true
-    go g.loop()
-    return nil
+    return g.StartContext(context.Background())
 }
 
+// close group and all connections, closed group can be started again
 func (g *BasicConnectionGroup) Close() error {
-    if !g.running {
-        return fmt.Errorf("connection '%s' group is not running", g.Name)
+    g.mutex.Lock()
+    if g.closed {
+        g.mutex.Unlock()
+        return nil
     }
+    g.closed = true
+    g.running = false
+    g.stopIdleTimer()
+    cancel := g.cancel
+    g.cancel = nil
+    members := g.connections
+    g.connections = make(connectionsMap, connectionPoolSize)
+    done := g.done
+    g.mutex.Unlock()
 
-    g.quit <- 1
+    // stop message loop, don't wait for it, Close() may be called by message handler
+    if cancel != nil {
+        cancel()
+    }
 
     // stop all connections
-    g.mutex.Lock()
-    defer g.mutex.Unlock()
-
-    for c := range g.connections {
-        c.Close()
+    for _, member := range members {
+        close(member.left)
+        member.conn.Close()
+        g.emitLeave(member.conn)
     }
-    g.connections = make(connectionsMap, connectionPoolSize)
 
+    close(done)
     return nil
 }
 
 func (g *BasicConnectionGroup) Add(c gbc.Connection) error {
     g.mutex.Lock()
-    defer g.mutex.Unlock()
+    err := g.add(c, g.messageChan)
+    g.mutex.Unlock()
 
-    _, ok := g.connections[c]
-    if ok {
-        return fmt.Errorf("connection '%p' already exists in group '%p'", &c, g)
+    if err != nil {
+        return err
     }
-    g.connections[c] = true
-    c.SetRawMessageChannel(g.messageChan)
-
+    g.emitJoin(c)
     return nil
 }
 
 func (g *BasicConnectionGroup) Remove(c gbc.Connection) error {
     g.mutex.Lock()
-    defer g.mutex.Unlock()
+    err := g.remove(c)
+    empty := false
+    if err == nil {
+        c.SetRawMessageChannel(nil)
+        empty = g.checkIdle()
+    }
+    g.mutex.Unlock()
 
-    _, ok := g.connections[c]
+    if err != nil {
+        return err
+    }
+    g.emitLeave(c)
+    if empty {
+        g.emitEmpty()
+    }
+    return nil
+}
+
+func (g *BasicConnectionGroup) MoveTo(c gbc.Connection, target gbc.ConnectionGroup) error {
+    t, ok := target.(*BasicConnectionGroup)
     if !ok {
-        return fmt.Errorf("not found connection '%p' in group '%p'", &c, g)
+        return fmt.Errorf("can't move connection %d to group %T", c.Id(), target)
+    }
+    if t == g {
+        return fmt.Errorf("connection %d already exists in group '%s'", c.Id(), g.Name)
+    }
+
+    // lock groups in same order, avoid deadlock when moving in opposite directions
+    first, second := g, t
+    if first.id > second.id {
+        first, second = second, first
     }
+    first.mutex.Lock()
+    second.mutex.Lock()
 
-    c.SetRawMessageChannel(nil)
-    delete(g.connections, c)
+    err := g.checkMember(c)
+    if err == nil && !t.running {
+        // nobody consumes messages of connection in target
+        err = fmt.Errorf("connection '%s' group is not running", t.Name)
+    }
+    if err == nil {
+        // connection stops delivering until messages received by g are handled,
+        // otherwise target may handle newer messages before them
+        err = t.add(c, nil)
+    }
+    if err == nil {
+        err = g.remove(c)
+    }
+    empty := err == nil && g.checkIdle()
+    member := t.connections[c.Id()]
+    loopDone := g.loopDone
+
+    second.mutex.Unlock()
+    first.mutex.Unlock()
+
+    if err != nil {
+        return err
+    }
+    // MoveTo() may be called by message handler of g, so wait in other goroutine
+    go g.handOver(member, t, loopDone)
+    g.emitLeave(c)
+    t.emitJoin(c)
+    if empty {
+        g.emitEmpty()
+    }
     return nil
 }
 
+func (g *BasicConnectionGroup) OnJoin(f gbc.ConnectionEventFunc) {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+    g.onJoinFunc = f
+}
+
+func (g *BasicConnectionGroup) OnLeave(f gbc.ConnectionEventFunc) {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+    g.onLeaveFunc = f
+}
+
+func (g *BasicConnectionGroup) OnEmpty(f gbc.GroupEventFunc) {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+    g.onEmptyFunc = f
+}
+
+func (g *BasicConnectionGroup) Done() <-chan struct{} {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+    return g.done
+}
+
 func (g *BasicConnectionGroup) RawMessageChan() chan gbc.RawMessage {
     return g.messageChan
 }
 
 func (g *BasicConnectionGroup) BroadcastWrite(b []byte) {
+    broadcast(g.list(), b, g.OutputFilter, nil)
+}
+
+func (g *BasicConnectionGroup) BroadcastWriteExcept(b []byte, exclude ...uint64) {
+    broadcast(g.list(), b, g.OutputFilter, exclude)
+}
+
+func (g *BasicConnectionGroup) SendTo(id uint64, b []byte) error {
+    c, err := g.Get(id)
+    if err != nil {
+        return err
+    }
+
+    _, err = c.Write(b)
+    return err
+}
+
+func (g *BasicConnectionGroup) Get(id uint64) (gbc.Connection, error) {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+
+    member, ok := g.connections[id]
+    if !ok {
+        return nil, gbc.ErrConnectionNotFound
+    }
+    return member.conn, nil
+}
+
+func (g *BasicConnectionGroup) Find(predicate func(c gbc.Connection) bool) []gbc.Connection {
+    var found []gbc.Connection
+    for _, c := range g.list() {
+        if predicate(c) {
+            found = append(found, c)
+        }
+    }
+    return found
+}
+
+func (g *BasicConnectionGroup) Range(f func(c gbc.Connection) bool) {
+    // f can add or remove connections
+    for _, c := range g.list() {
+        if !f(c) {
+            break
+        }
+    }
+}
+
+func (g *BasicConnectionGroup) Len() int {
     g.mutex.Lock()
-    list := make([]gbc.Connection, len(g.connections))
-    i := 0
-    for c := range g.connections {
-        list[i] = c
-        i++
+    defer g.mutex.Unlock()
+    return len(g.connections)
+}
+
+// public
+
+// start message loop, group will be closed after ctx done,
+// must not be called by message handler of the group
+func (g *BasicConnectionGroup) StartContext(ctx context.Context) error {
+    g.mutex.Lock()
+    if g.running {
+        g.mutex.Unlock()
+        return fmt.Errorf("connection '%s' group is already running", g.Name)
+    }
+
+    if g.closed {
+        // restart
+        g.closed = false
+        g.joined = false
+        g.done = make(chan struct{})
     }
+
+    ctx, cancel := context.WithCancel(ctx)
+    queue := NewMessageQueue(g.QueueSize, g.OverflowPolicy)
+    queue.onDiscard = g.handled
+    g.queue = queue
+    g.running = true
+    g.cancel = cancel
+    prevLoopDone := g.loopDone
+    loopDone := make(chan struct{})
+    g.loopDone = loopDone
+    g.checkIdle()
     g.mutex.Unlock()
 
-    for _, c := range list {
-        c := c
-        go func() {
-            c.Write(b)
-        }()
+    if prevLoopDone != nil {
+        // waiting for loop of last running exited
+        <-prevLoopDone
+    }
+
+    go g.loop(ctx, queue, loopDone)
+    return nil
+}
+
+func (g *BasicConnectionGroup) IsRunning() bool {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+    return g.running
+}
+
+// metrics of message queue, zero if group never started
+func (g *BasicConnectionGroup) QueueStats() MessageQueueStats {
+    g.mutex.Lock()
+    q := g.queue
+    g.mutex.Unlock()
+
+    if q == nil {
+        return MessageQueueStats{}
     }
+    return q.Stats()
 }
 
 // private
 
-func (g *BasicConnectionGroup) loop() {
+func (g *BasicConnectionGroup) loop(ctx context.Context, queue *MessageQueue, loopDone chan struct{}) {
+    defer close(loopDone)
+
+    received := make(chan struct{})
+    go g.receive(ctx, queue, received)
 
-loop:
+    for {
+        m, ok := queue.Pop(ctx)
+        if !ok {
+            break
+        }
+
+        g.mutex.Lock()
+        f := g.onRawMessageFunc
+        g.mutex.Unlock()
+
+        if f != nil {
+            f(m)
+        }
+        g.handled(m)
+    }
+
+    // cancelled by Close() or parent context
+    <-received
+    // messages left in queue will never be handled
+    g.releaseDrained()
+    go g.closeByContext(loopDone)
+}
+
+// move messages from connections to queue, so slow handler doesn't block reading of connections
+func (g *BasicConnectionGroup) receive(ctx context.Context, queue *MessageQueue, received chan struct{}) {
+    defer close(received)
+
+    priority := g.PriorityFunc
     for {
         select {
         case m := <-g.messageChan:
-            if g.onRawMessageFunc != nil {
-                g.onRawMessageFunc(m)
+            g.received(m)
+            p := MessagePriorityNormal
+            if priority != nil {
+                p = priority(m)
+            }
+            queue.Push(ctx, m, p)
+
+        case f := <-g.flushChan:
+            // messages of connection were received before, and already in queue
+            g.waitDrained(f)
+
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+// close group when parent context done
+func (g *BasicConnectionGroup) closeByContext(loopDone chan struct{}) {
+    <-loopDone
+
+    g.mutex.Lock()
+    // already closed, or restarted with new loop
+    current := g.running && g.loopDone == loopDone
+    g.mutex.Unlock()
+
+    if current {
+        g.Close()
+    }
+}
+
+// rebind message channel of connection moved to t after messages received by g are handled
+func (g *BasicConnectionGroup) handOver(member *groupMember, t *BasicConnectionGroup, loopDone chan struct{}) {
+    c := member.conn
+    if loopDone != nil {
+        drained := make(chan struct{})
+        select {
+        case g.flushChan <- groupFlush{id: c.Id(), drained: drained}:
+            select {
+            case <-drained:
+            case <-loopDone:
             }
+        case <-loopDone:
+        }
+    }
+
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+    if t.connections[c.Id()] == member {
+        // not left or moved again
+        c.SetRawMessageChannel(t.messageChan)
+    }
+}
+
+func (g *BasicConnectionGroup) received(m gbc.RawMessage) {
+    id, ok := messageConnectionId(m)
+    if !ok {
+        return
+    }
+
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+    g.pending[id]++
+}
+
+// message received from connection is handled or discarded by queue
+func (g *BasicConnectionGroup) handled(m gbc.RawMessage) {
+    id, ok := messageConnectionId(m)
+    if !ok {
+        return
+    }
+
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+
+    if g.pending[id] > 1 {
+        g.pending[id]--
+        return
+    }
+    delete(g.pending, id)
+    for _, drained := range g.drainWaiters[id] {
+        close(drained)
+    }
+    delete(g.drainWaiters, id)
+}
+
+func (g *BasicConnectionGroup) waitDrained(f groupFlush) {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+
+    if g.pending[f.id] == 0 {
+        close(f.drained)
+        return
+    }
+    g.drainWaiters[f.id] = append(g.drainWaiters[f.id], f.drained)
+}
+
+func (g *BasicConnectionGroup) releaseDrained() {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
 
-        case <-g.quit:
-            break loop
+    for _, list := range g.drainWaiters {
+        for _, drained := range list {
+            close(drained)
         }
     }
+    g.pending = make(map[uint64]int)
+    g.drainWaiters = make(map[uint64][]chan struct{})
+}
 
-    g.running = false
+// must hold mutex, message channel of connection is rebound to mc
+func (g *BasicConnectionGroup) add(c gbc.Connection, mc chan gbc.RawMessage) error {
+    if g.closed {
+        return fmt.Errorf("connection '%s' group is closed", g.Name)
+    }
+
+    _, ok := g.connections[c.Id()]
+    if ok {
+        return fmt.Errorf("connection %d already exists in group '%s'", c.Id(), g.Name)
+    }
+    member := &groupMember{
+        conn: c,
+        left: make(chan struct{}),
+    }
+    g.connections[c.Id()] = member
+    c.SetRawMessageChannel(mc)
+    g.joined = true
+    g.stopIdleTimer()
+
+    go g.removeAfterClosed(member)
+    return nil
+}
+
+// must hold mutex
+func (g *BasicConnectionGroup) checkMember(c gbc.Connection) error {
+    member, ok := g.connections[c.Id()]
+    if !ok || member.conn != c {
+        return fmt.Errorf("not found connection %d in group '%s'", c.Id(), g.Name)
+    }
+    return nil
+}
+
+// must hold mutex
+func (g *BasicConnectionGroup) remove(c gbc.Connection) error {
+    err := g.checkMember(c)
+    if err != nil {
+        return err
+    }
+
+    close(g.connections[c.Id()].left)
+    delete(g.connections, c.Id())
+    return nil
+}
+
+// must hold mutex, returns true if group is empty, and start idle timer
+func (g *BasicConnectionGroup) checkIdle() bool {
+    if len(g.connections) > 0 || g.closed {
+        return false
+    }
+
+    if g.IdleTimeout > 0 && g.running && g.joined && g.idleTimer == nil {
+        gen := g.idleGen
+        g.idleTimer = time.AfterFunc(g.IdleTimeout, func() {
+            g.closeIfIdle(gen)
+        })
+    }
+    return true
+}
+
+// must hold mutex
+func (g *BasicConnectionGroup) stopIdleTimer() {
+    if g.idleTimer != nil {
+        g.idleTimer.Stop()
+        g.idleTimer = nil
+        g.idleGen++
+    }
+}
+
+func (g *BasicConnectionGroup) closeIfIdle(gen int) {
+    g.mutex.Lock()
+    idle := gen == g.idleGen && len(g.connections) == 0
+    g.mutex.Unlock()
+
+    if idle {
+        g.Close()
+    }
+}
+
+func (g *BasicConnectionGroup) emitJoin(c gbc.Connection) {
+    g.mutex.Lock()
+    f := g.onJoinFunc
+    g.mutex.Unlock()
+
+    if f != nil {
+        f(g, c)
+    }
+}
+
+func (g *BasicConnectionGroup) emitLeave(c gbc.Connection) {
+    g.mutex.Lock()
+    f := g.onLeaveFunc
+    g.mutex.Unlock()
+
+    if f != nil {
+        f(g, c)
+    }
+}
+
+func (g *BasicConnectionGroup) emitEmpty() {
+    g.mutex.Lock()
+    f := g.onEmptyFunc
+    g.mutex.Unlock()
+
+    if f != nil {
+        f(g)
+    }
+}
+
+// get snapshot of connections
+func (g *BasicConnectionGroup) list() []gbc.Connection {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+
+    list := make([]gbc.Connection, 0, len(g.connections))
+    for _, member := range g.connections {
+        list = append(list, member.conn)
+    }
+    return list
+}
+
+func (g *BasicConnectionGroup) removeAfterClosed(member *groupMember) {
+    select {
+    case <-member.conn.Done():
+        g.Remove(member.conn)
+    case <-member.left:
+    }
+}
+
+func messageConnectionId(m gbc.RawMessage) (uint64, bool) {
+    cm, ok := m.(gbc.ConnectionRawMessage)
+    if !ok || cm.Connection() == nil {
+        return 0, false
+    }
+    return cm.Connection().Id(), true
+}
+
+// run shared filter once, then enqueue prepared bytes to connections
+func broadcast(list []gbc.Connection, b []byte, shared gbc.OutputFilter, exclude []uint64) {
+    var p []byte
+    if shared != nil {
+        var err error
+        // filters may change bytes in place
+        p, err = shared.WriteBytes(append([]byte(nil), b...))
+        if err != nil {
+            clog.PrintWarn("broadcasting failed, %s", err)
+            return
+        }
+    }
+
+next:
+    for _, c := range list {
+        for _, id := range exclude {
+            if c.Id() == id {
+                continue next
+            }
+        }
+
+        w, ok := c.(gbc.AsyncWriter)
+        if !ok {
+            c := c
+            go func() {
+                c.Write(b)
+            }()
+            continue
+        }
+
+        // connection misses the message if it's too slow
+        if shared != nil {
+            w.EnqueuePrepared(p)
+        } else {
+            w.Enqueue(b)
+        }
+    }
 }
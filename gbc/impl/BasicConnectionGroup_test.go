@@ -0,0 +1,261 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc"
+)
+
+// run with go test -race
+
+func waitGroupDone(t *testing.T, done <-chan struct{}) {
+    t.Helper()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("group not closed")
+    }
+}
+
+func TestBasicConnectionGroupLifecycleRace(t *testing.T) {
+    for i := 0; i < 50; i++ {
+        var received int32
+        g := NewBasicConnectionGroup("race", func(gbc.RawMessage) error {
+            atomic.AddInt32(&received, 1)
+            return nil
+        })
+
+        var conns []*BasicConnection
+        for j := 0; j < 5; j++ {
+            c, remote, _ := newTestConnection()
+            defer remote.Close()
+            if err := c.Start(); err != nil {
+                t.Fatal(err)
+            }
+            conns = append(conns, c)
+        }
+
+        wg := &sync.WaitGroup{}
+        run := func(f func()) {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                f()
+            }()
+        }
+        run(func() { g.Start() })
+        run(func() { g.Close() })
+        for _, c := range conns {
+            c := c
+            run(func() {
+                if g.Add(c) == nil {
+                    g.BroadcastWrite([]byte{1})
+                    g.Remove(c)
+                }
+            })
+            run(func() { g.BroadcastWriteExcept([]byte{2}, c.Id()) })
+        }
+        wg.Wait()
+
+        g.Close()
+        waitGroupDone(t, g.Done())
+        if g.IsRunning() || g.Len() != 0 {
+            t.Fatalf("running %v, %d connections left", g.IsRunning(), g.Len())
+        }
+        if g.Add(conns[0]) == nil {
+            t.Fatal("add to closed group")
+        }
+        for _, c := range conns {
+            c.Close()
+        }
+    }
+}
+
+func TestBasicConnectionGroupRestart(t *testing.T) {
+    received := make(chan gbc.RawMessage, 16)
+    g := NewBasicConnectionGroup("restart", func(m gbc.RawMessage) error {
+        received <- m
+        return nil
+    })
+
+    if err := g.Start(); err != nil {
+        t.Fatal(err)
+    }
+    if err := g.Start(); err == nil {
+        t.Fatal("started twice")
+    }
+
+    c, remote, closed := newTestConnection()
+    defer remote.Close()
+    c.Start()
+    if err := g.Add(c); err != nil {
+        t.Fatal(err)
+    }
+
+    done := g.Done()
+    g.Close()
+    waitGroupDone(t, done)
+    waitConnectionDone(t, c)
+    if n := atomic.LoadInt32(closed); n != 1 {
+        t.Fatalf("OnClose called %d times", n)
+    }
+
+    // closed group can be started again with new Done channel
+    if err := g.Start(); err != nil {
+        t.Fatal(err)
+    }
+    if !g.IsRunning() {
+        t.Fatal("not running after restart")
+    }
+    select {
+    case <-g.Done():
+        t.Fatal("done after restart")
+    default:
+    }
+
+    c2, remote2, _ := newTestConnection()
+    defer remote2.Close()
+    c2.Start()
+    if err := g.Add(c2); err != nil {
+        t.Fatal(err)
+    }
+    go remote2.Write(NewCommandMessageFromData(1, 2, CommandMessageClangType, []byte("hi")).GenBytes())
+    select {
+    case m := <-received:
+        if string(m.DataBytes()) != "hi" {
+            t.Fatalf("received %v", m.DataBytes())
+        }
+    case <-time.After(time.Second):
+        t.Fatal("message not received after restart")
+    }
+
+    g.Close()
+    waitGroupDone(t, g.Done())
+    waitConnectionDone(t, c2)
+}
+
+func TestBasicConnectionGroupRemoveNotMember(t *testing.T) {
+    g := NewBasicConnectionGroup("remove", func(gbc.RawMessage) error { return nil })
+    var empty int32
+    g.OnEmpty(func(gbc.ConnectionGroup) {
+        atomic.AddInt32(&empty, 1)
+    })
+    g.Start()
+    defer g.Close()
+
+    c, remote, _ := newTestConnection()
+    defer remote.Close()
+    if err := g.Add(c); err != nil {
+        t.Fatal(err)
+    }
+    if err := g.Remove(c); err != nil {
+        t.Fatal(err)
+    }
+
+    // failed removing doesn't start idle timer or emit empty event
+    g.IdleTimeout = time.Millisecond * 10
+    if err := g.Remove(c); err == nil {
+        t.Fatal("removed connection not in group")
+    }
+    select {
+    case <-g.Done():
+        t.Fatal("group closed by idle timer")
+    case <-time.After(time.Millisecond * 50):
+    }
+    if n := atomic.LoadInt32(&empty); n != 1 {
+        t.Fatalf("OnEmpty called %d times", n)
+    }
+}
+
+func TestBasicConnectionGroupMoveToOrder(t *testing.T) {
+    var mutex sync.Mutex
+    var handled []string
+    record := func(m gbc.RawMessage) {
+        mutex.Lock()
+        handled = append(handled, string(m.DataBytes()))
+        mutex.Unlock()
+    }
+
+    // source is slow, messages are queued when moving
+    ga := NewBasicConnectionGroup("a", func(m gbc.RawMessage) error {
+        time.Sleep(time.Millisecond * 2)
+        record(m)
+        return nil
+    })
+    gb := NewBasicConnectionGroup("b", func(m gbc.RawMessage) error {
+        record(m)
+        return nil
+    })
+    ga.Start()
+    defer ga.Close()
+    gb.Start()
+    defer gb.Close()
+
+    c, remote, _ := newTestConnection()
+    defer remote.Close()
+    if err := ga.Add(c); err != nil {
+        t.Fatal(err)
+    }
+    c.Start()
+
+    const count = 40
+    send := func(from, to int) {
+        for i := from; i < to; i++ {
+            remote.Write(NewCommandMessageFromData(1, 1, CommandMessageClangType, []byte(fmt.Sprintf("%02d", i))).GenBytes())
+        }
+    }
+    send(0, count/2)
+    if err := ga.MoveTo(c, gb); err != nil {
+        t.Fatal(err)
+    }
+    send(count/2, count)
+
+    deadline := time.Now().Add(time.Second)
+    for {
+        mutex.Lock()
+        n := len(handled)
+        mutex.Unlock()
+        if n == count {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("handled %d messages", n)
+        }
+        time.Sleep(time.Millisecond * 5)
+    }
+
+    // messages queued in source are handled before messages handled by target
+    mutex.Lock()
+    defer mutex.Unlock()
+    for i, s := range handled {
+        if s != fmt.Sprintf("%02d", i) {
+            t.Fatalf("handled out of order: %v", handled)
+        }
+    }
+}
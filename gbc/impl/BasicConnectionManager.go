@@ -35,8 +35,23 @@ type (
     BasicConnectionManager struct {
         DefaultGroup *BasicConnectionGroup
 
+        // all named groups, include DefaultGroup
+        Groups *BasicGroupRegistry
+
+        // connections can subscribe to many topics besides the group handles their messages
+        Topics *BasicTopicHub
+
+        // if set, session of closed connection will be saved for restoring
+        SessionStore gbc.SessionStore
+
+        // if set, BasicConnection can be resumed after reconnect
+        Resumer *SessionResumer
+
+        // if set, limit inbound messages of each BasicConnection
+        RateLimitPolicy *RateLimitPolicy
+
         onConnectFunc gbc.OnConnectFunc
-        groups        map[gbc.ConnectionGroup]bool
+        connections   map[uint64]gbc.Connection
         quit          chan int
         mutex         *sync.Mutex
     }
@@ -45,8 +60,12 @@ type (
 func NewBasicConnectionManager() *BasicConnectionManager {
     cm := &BasicConnectionManager{
         DefaultGroup: NewBasicConnectionGroup("incoming", nil),
+        Groups:       NewBasicGroupRegistry(),
+        Topics:       NewBasicTopicHub(),
+        connections:  make(map[uint64]gbc.Connection, connectionPoolSize),
         mutex:        &sync.Mutex{},
     }
+    cm.Groups.Add(cm.DefaultGroup.Name, cm.DefaultGroup)
     return cm
 }
 
@@ -59,7 +78,6 @@ func (cm *BasicConnectionManager) OnConnect(f gbc.OnConnectFunc) {
 func (cm *BasicConnectionManager) Start(l net.Listener) (err error) {
     clog.PrintInfo("listening at: %s", l.Addr().String())
 
-    cm.groups = make(map[gbc.ConnectionGroup]bool)
     cm.quit = make(chan int)
 
     // handle connect
@@ -79,10 +97,7 @@ loop:
     l.Close()
 
     // close all groups and clear
-    for group := range cm.groups {
-        group.Close()
-    }
-    cm.groups = make(map[gbc.ConnectionGroup]bool)
+    cm.Groups.CloseAll()
 
     clog.PrintInfo("closed")
     return
@@ -96,15 +111,58 @@ func (cm *BasicConnectionManager) Stop() {
     }
 }
 
+// interface ConnectionLocator
+
+func (cm *BasicConnectionManager) Connection(id uint64) (gbc.Connection, error) {
+    cm.mutex.Lock()
+    defer cm.mutex.Unlock()
+
+    c, ok := cm.connections[id]
+    if !ok {
+        return nil, gbc.ErrConnectionNotFound
+    }
+    return c, nil
+}
+
+// public
+
+// create a group and start it, group will be removed from Groups after closed
+func (cm *BasicConnectionManager) NewGroup(name string, f gbc.OnRawMessageFunc) (*BasicConnectionGroup, error) {
+    g := NewBasicConnectionGroup(name, f)
+    err := cm.Groups.Add(name, g)
+    if err != nil {
+        return nil, err
+    }
+
+    g.Start()
+    return g, nil
+}
+
+// attach the saved session to connection, client presents token after reconnect
+func (cm *BasicConnectionManager) RestoreSession(c gbc.Connection, token string) error {
+    if cm.SessionStore == nil {
+        return gbc.ErrSessionNotFound
+    }
+
+    s, err := cm.SessionStore.Restore(token)
+    if err != nil {
+        return err
+    }
+    c.SetSession(s)
+    return nil
+}
+
 // private
 
 func (cm *BasicConnectionManager) startAcceptConnect(l net.Listener) {
     for {
         rawConn, err := l.Accept()
         if err != nil {
-            if !strings.Contains(err.Error(), "use of closed network connection") {
-                clog.PrintWarn(err.Error())
+            if strings.Contains(err.Error(), "use of closed network connection") {
+                // listener closed by Stop()
+                return
             }
+            clog.PrintWarn(err.Error())
             continue
         }
 
@@ -114,7 +172,39 @@ func (cm *BasicConnectionManager) startAcceptConnect(l net.Listener) {
         } else {
             conn = cm.onConnectFunc(rawConn)
         }
+        bc, ok := conn.(*BasicConnection)
+        if ok && cm.Resumer != nil {
+            cm.Resumer.Manage(bc)
+        }
+        if ok && cm.RateLimitPolicy != nil && bc.RateLimiter == nil {
+            bc.RateLimiter = NewRateLimiter(cm.RateLimitPolicy)
+        }
+
+        cm.mutex.Lock()
+        cm.connections[conn.Id()] = conn
+        cm.mutex.Unlock()
+
         cm.DefaultGroup.Add(conn)
         conn.Start()
+
+        go cm.forgetAfterClosed(conn)
+    }
+}
+
+func (cm *BasicConnectionManager) forgetAfterClosed(c gbc.Connection) {
+    <-c.Done()
+
+    cm.mutex.Lock()
+    delete(cm.connections, c.Id())
+    cm.mutex.Unlock()
+
+    // client can't restore session never issued token
+    s := c.Session()
+    if cm.SessionStore == nil || s == nil || !s.HasToken() {
+        return
+    }
+    err := cm.SessionStore.Save(s)
+    if err != nil {
+        clog.PrintWarn("save session of connection %d failed, %s", c.Id(), err)
     }
 }
@@ -0,0 +1,292 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "io"
+    "io/ioutil"
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc"
+)
+
+// run with go test -race
+
+func newTestConnection() (*BasicConnection, net.Conn, *int32) {
+    local, remote := net.Pipe()
+    go io.Copy(ioutil.Discard, remote)
+    c := NewBasicConnection(local, NewCommandMessageInputFilter())
+    c.SetRawMessageChannel(make(chan gbc.RawMessage, 16))
+    closed := new(int32)
+    c.OnClose(func(gbc.Connection, error) {
+        atomic.AddInt32(closed, 1)
+    })
+    return c, remote, closed
+}
+
+func waitConnectionDone(t *testing.T, c *BasicConnection) {
+    t.Helper()
+    select {
+    case <-c.Done():
+    case <-time.After(time.Second):
+        t.Fatalf("connection not closed, state is %s", c.State())
+    }
+}
+
+// suspend calling by loop after link lost
+func suspendTestConnection(c *BasicConnection) {
+    c.mutex.Lock()
+    link := c.link
+    c.mutex.Unlock()
+    if link != nil {
+        c.suspend(link, nil)
+    }
+}
+
+func TestBasicConnectionStartOnce(t *testing.T) {
+    c, remote, closed := newTestConnection()
+    defer remote.Close()
+
+    var started, failed int32
+    wg := &sync.WaitGroup{}
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if c.Start() == nil {
+                atomic.AddInt32(&started, 1)
+            } else {
+                atomic.AddInt32(&failed, 1)
+            }
+        }()
+    }
+    wg.Wait()
+
+    if started != 1 || failed != 19 {
+        t.Fatalf("started %d times, failed %d times", started, failed)
+    }
+    if c.State() != ConnectionStateStarted {
+        t.Fatalf("state is %s", c.State())
+    }
+
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            c.Close()
+        }()
+    }
+    wg.Wait()
+    waitConnectionDone(t, c)
+
+    if c.State() != ConnectionStateClosed {
+        t.Fatalf("state is %s", c.State())
+    }
+    if n := atomic.LoadInt32(closed); n != 1 {
+        t.Fatalf("OnClose called %d times", n)
+    }
+}
+
+func TestBasicConnectionIllegalTransitions(t *testing.T) {
+    c, remote, closed := newTestConnection()
+    defer remote.Close()
+
+    // link is not started, can't be suspended
+    c.resumeGrace = time.Hour
+    suspendTestConnection(c)
+    if c.State() != ConnectionStateNew {
+        t.Fatalf("state is %s", c.State())
+    }
+
+    if err := c.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Start(); err == nil {
+        t.Fatal("closed connection started")
+    }
+    if _, err := c.Write([]byte{1}); err != gbc.ErrConnectionClosed {
+        t.Fatalf("write to closed connection, %v", err)
+    }
+    if err := c.Enqueue([]byte{1}); err != gbc.ErrConnectionClosed {
+        t.Fatalf("enqueue to closed connection, %v", err)
+    }
+    if _, _, _, err := c.detach(); err != gbc.ErrConnectionClosed {
+        t.Fatalf("detach closed connection, %v", err)
+    }
+    if n := atomic.LoadInt32(closed); n != 1 {
+        t.Fatalf("OnClose called %d times", n)
+    }
+}
+
+func TestBasicConnectionSuspendOnce(t *testing.T) {
+    c, remote, closed := newTestConnection()
+    defer remote.Close()
+    c.replay = NewReplayBuffer(16)
+    c.resumeGrace = time.Hour
+
+    if err := c.Start(); err != nil {
+        t.Fatal(err)
+    }
+
+    wg := &sync.WaitGroup{}
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            suspendTestConnection(c)
+        }()
+    }
+    wg.Wait()
+
+    if c.State() != ConnectionStateSuspended {
+        t.Fatalf("state is %s", c.State())
+    }
+    if err := c.Start(); err == nil {
+        t.Fatal("suspended connection started")
+    }
+
+    // closing suspended connection stops grace timer
+    c.Close()
+    waitConnectionDone(t, c)
+    c.mutex.Lock()
+    timer := c.graceTimer
+    c.mutex.Unlock()
+    if timer != nil {
+        t.Fatal("grace timer not stopped")
+    }
+    if n := atomic.LoadInt32(closed); n != 1 {
+        t.Fatalf("OnClose called %d times", n)
+    }
+}
+
+func TestBasicConnectionStartCloseSuspendRace(t *testing.T) {
+    for i := 0; i < 200; i++ {
+        c, remote, closed := newTestConnection()
+        c.replay = NewReplayBuffer(16)
+        c.resumeGrace = time.Millisecond
+
+        var started int32
+        wg := &sync.WaitGroup{}
+        wg.Add(3)
+        go func() {
+            defer wg.Done()
+            if c.Start() == nil {
+                atomic.StoreInt32(&started, 1)
+            }
+        }()
+        go func() {
+            defer wg.Done()
+            c.Close()
+        }()
+        go func() {
+            defer wg.Done()
+            suspendTestConnection(c)
+        }()
+        wg.Wait()
+
+        // suspended connection is closed by grace timer
+        c.Close()
+        waitConnectionDone(t, c)
+        deadline := time.Now().Add(time.Second)
+        for c.State() != ConnectionStateClosed && time.Now().Before(deadline) {
+            time.Sleep(time.Millisecond)
+        }
+        if c.State() != ConnectionStateClosed {
+            t.Fatalf("state is %s", c.State())
+        }
+        if n := atomic.LoadInt32(closed); n != 1 {
+            t.Fatalf("OnClose called %d times", n)
+        }
+        if c.Start() == nil {
+            t.Fatal("closed connection started")
+        }
+        remote.Close()
+    }
+}
+
+func TestBasicConnectionNoMessageAfterClose(t *testing.T) {
+    frame := NewCommandMessageFromData(1, 1, 0, []byte("hello")).GenBytes()
+
+    for i := 0; i < 50; i++ {
+        c, remote, _ := newTestConnection()
+        mc := make(chan gbc.RawMessage)
+        c.SetRawMessageChannel(mc)
+        if err := c.Start(); err != nil {
+            t.Fatal(err)
+        }
+
+        go func() {
+            for {
+                if _, err := remote.Write(frame); err != nil {
+                    return
+                }
+            }
+        }()
+
+        // stop receiving once Done() is closed, late message would block forwarder
+        var received int32
+        stopped := make(chan struct{})
+        go func() {
+            defer close(stopped)
+            for {
+                select {
+                case <-c.Done():
+                    return
+                default:
+                }
+                select {
+                case <-mc:
+                    atomic.AddInt32(&received, 1)
+                case <-c.Done():
+                    return
+                }
+            }
+        }()
+
+        for atomic.LoadInt32(&received) < int32(i%5+1) {
+            time.Sleep(time.Millisecond)
+        }
+        closeDone := make(chan struct{})
+        go func() {
+            c.Close()
+            close(closeDone)
+        }()
+        select {
+        case <-closeDone:
+        case <-time.After(time.Second):
+            t.Fatal("close blocked by delivering")
+        }
+        <-stopped
+
+        select {
+        case <-mc:
+            t.Fatal("message delivered after closed")
+        case <-time.After(5 * time.Millisecond):
+        }
+        remote.Close()
+    }
+}
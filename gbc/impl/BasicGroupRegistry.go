@@ -0,0 +1,127 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+
+    "github.com/dualface/go-gbc/gbc"
+)
+
+type (
+    // named groups, group is removed from registry after closed
+    BasicGroupRegistry struct {
+        groups map[string]gbc.ConnectionGroup
+        mutex  *sync.Mutex
+    }
+)
+
+func NewBasicGroupRegistry() *BasicGroupRegistry {
+    r := &BasicGroupRegistry{
+        groups: make(map[string]gbc.ConnectionGroup),
+        mutex:  &sync.Mutex{},
+    }
+    return r
+}
+
+// public
+
+func (r *BasicGroupRegistry) Add(name string, g gbc.ConnectionGroup) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    _, ok := r.groups[name]
+    if ok {
+        return fmt.Errorf("connection '%s' group already exists", name)
+    }
+    r.groups[name] = g
+
+    go func() {
+        <-g.Done()
+        r.remove(name, g)
+    }()
+    return nil
+}
+
+// get group by name, returns nil if not found
+func (r *BasicGroupRegistry) Get(name string) gbc.ConnectionGroup {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return r.groups[name]
+}
+
+// get names of all groups
+func (r *BasicGroupRegistry) Names() []string {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    names := make([]string, 0, len(r.groups))
+    for name := range r.groups {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// find groups
+func (r *BasicGroupRegistry) Find(predicate func(name string, g gbc.ConnectionGroup) bool) []gbc.ConnectionGroup {
+    var found []gbc.ConnectionGroup
+    for _, name := range r.Names() {
+        g := r.Get(name)
+        if g != nil && predicate(name, g) {
+            found = append(found, g)
+        }
+    }
+    return found
+}
+
+// close group and remove it from registry
+func (r *BasicGroupRegistry) Close(name string) error {
+    g := r.Get(name)
+    if g == nil {
+        return fmt.Errorf("not found connection '%s' group", name)
+    }
+
+    r.remove(name, g)
+    return g.Close()
+}
+
+// close all groups
+func (r *BasicGroupRegistry) CloseAll() {
+    for _, name := range r.Names() {
+        r.Close(name)
+    }
+}
+
+// private
+
+func (r *BasicGroupRegistry) remove(name string, g gbc.ConnectionGroup) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    if r.groups[name] == g {
+        delete(r.groups, name)
+    }
+}
@@ -0,0 +1,173 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "sync"
+)
+
+const (
+    sessionTokenLen = 16 // 16 random bytes, 32 hex chars
+)
+
+type (
+    BasicSession struct {
+        token  string
+        values map[string]interface{}
+        mutex  *sync.RWMutex
+    }
+)
+
+func NewBasicSession() *BasicSession {
+    s := &BasicSession{
+        values: make(map[string]interface{}),
+        mutex:  &sync.RWMutex{},
+    }
+    return s
+}
+
+// interface Session
+
+func (s *BasicSession) Token() string {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if s.token == "" {
+        s.token = genSessionToken()
+    }
+    return s.token
+}
+
+func (s *BasicSession) HasToken() bool {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+    return s.token != ""
+}
+
+func (s *BasicSession) Get(key string) (interface{}, bool) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    v, ok := s.values[key]
+    return v, ok
+}
+
+func (s *BasicSession) GetString(key string) (string, bool) {
+    v, ok := s.Get(key)
+    if !ok {
+        return "", false
+    }
+    str, ok := v.(string)
+    return str, ok
+}
+
+func (s *BasicSession) GetInt(key string) (int64, bool) {
+    v, ok := s.Get(key)
+    if !ok {
+        return 0, false
+    }
+
+    // values set from Lua are float64
+    switch n := v.(type) {
+    case int:
+        return int64(n), true
+    case int32:
+        return int64(n), true
+    case int64:
+        return n, true
+    case uint32:
+        return int64(n), true
+    case uint64:
+        return int64(n), true
+    case float32:
+        return int64(n), true
+    case float64:
+        return int64(n), true
+    default:
+        return 0, false
+    }
+}
+
+func (s *BasicSession) GetFloat(key string) (float64, bool) {
+    v, ok := s.Get(key)
+    if !ok {
+        return 0, false
+    }
+
+    switch n := v.(type) {
+    case float32:
+        return float64(n), true
+    case float64:
+        return n, true
+    default:
+        i, ok := s.GetInt(key)
+        return float64(i), ok
+    }
+}
+
+func (s *BasicSession) GetBool(key string) (bool, bool) {
+    v, ok := s.Get(key)
+    if !ok {
+        return false, false
+    }
+    b, ok := v.(bool)
+    return b, ok
+}
+
+func (s *BasicSession) Set(key string, value interface{}) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    s.values[key] = value
+}
+
+func (s *BasicSession) Delete(key string) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    delete(s.values, key)
+}
+
+func (s *BasicSession) Keys() []string {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    keys := make([]string, 0, len(s.values))
+    for k := range s.values {
+        keys = append(keys, k)
+    }
+    return keys
+}
+
+// private
+
+func genSessionToken() string {
+    b := make([]byte, sessionTokenLen)
+    _, err := rand.Read(b)
+    if err != nil {
+        panic(err)
+    }
+    return hex.EncodeToString(b)
+}
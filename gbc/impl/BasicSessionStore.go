@@ -0,0 +1,140 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc"
+)
+
+const (
+    DefaultSessionStoreTTL         = time.Minute * 5
+    DefaultSessionStoreMaxSessions = 10000
+
+    sessionStoreSweepInterval = time.Second
+)
+
+type (
+    sessionStoreEntry struct {
+        session gbc.Session
+        expire  time.Time
+    }
+
+    // keep sessions of closed connections in memory for a while
+    BasicSessionStore struct {
+        // saved session expires after TTL
+        TTL time.Duration
+        // max number of saved sessions, Save() fails when full
+        MaxSessions int
+
+        sessions  map[string]*sessionStoreEntry
+        lastSweep time.Time
+        mutex     *sync.Mutex
+    }
+)
+
+// zero ttl means DefaultSessionStoreTTL, zero maxSessions means DefaultSessionStoreMaxSessions
+func NewBasicSessionStore(ttl time.Duration, maxSessions int) *BasicSessionStore {
+    if ttl <= 0 {
+        ttl = DefaultSessionStoreTTL
+    }
+    if maxSessions < 1 {
+        maxSessions = DefaultSessionStoreMaxSessions
+    }
+
+    st := &BasicSessionStore{
+        TTL:         ttl,
+        MaxSessions: maxSessions,
+        sessions:    make(map[string]*sessionStoreEntry),
+        mutex:       &sync.Mutex{},
+    }
+    return st
+}
+
+// interface SessionStore
+
+func (st *BasicSessionStore) Save(s gbc.Session) error {
+    st.mutex.Lock()
+    defer st.mutex.Unlock()
+
+    if !s.HasToken() {
+        return fmt.Errorf("session has no token, can't be restored")
+    }
+
+    now := time.Now()
+    st.removeExpired(now)
+    maxSessions := st.MaxSessions
+    if maxSessions < 1 {
+        maxSessions = DefaultSessionStoreMaxSessions
+    }
+    if len(st.sessions) >= maxSessions {
+        return fmt.Errorf("session store is full, %d sessions", len(st.sessions))
+    }
+    ttl := st.TTL
+    if ttl <= 0 {
+        ttl = DefaultSessionStoreTTL
+    }
+    st.sessions[s.Token()] = &sessionStoreEntry{session: s, expire: now.Add(ttl)}
+    return nil
+}
+
+func (st *BasicSessionStore) Restore(token string) (gbc.Session, error) {
+    st.mutex.Lock()
+    defer st.mutex.Unlock()
+
+    now := time.Now()
+    st.removeExpired(now)
+    e, ok := st.sessions[token]
+    if !ok {
+        return nil, gbc.ErrSessionNotFound
+    }
+
+    // session can be restored only once
+    delete(st.sessions, token)
+    if e.expired(now) {
+        return nil, gbc.ErrSessionNotFound
+    }
+    return e.session, nil
+}
+
+// private
+
+func (st *BasicSessionStore) removeExpired(now time.Time) {
+    if now.Sub(st.lastSweep) < sessionStoreSweepInterval {
+        return
+    }
+    st.lastSweep = now
+
+    for token, e := range st.sessions {
+        if e.expired(now) {
+            delete(st.sessions, token)
+        }
+    }
+}
+
+func (e *sessionStoreEntry) expired(now time.Time) bool {
+    return now.After(e.expire)
+}
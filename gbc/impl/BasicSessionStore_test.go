@@ -0,0 +1,82 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "testing"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc"
+)
+
+func TestBasicSessionStoreTTL(t *testing.T) {
+    st := NewBasicSessionStore(0, 0)
+    if st.TTL != DefaultSessionStoreTTL || st.MaxSessions != DefaultSessionStoreMaxSessions {
+        t.Fatalf("ttl %s, max sessions %d", st.TTL, st.MaxSessions)
+    }
+
+    st = NewBasicSessionStore(time.Millisecond*10, 0)
+    s := NewBasicSession()
+    token := s.Token()
+    if err := st.Save(s); err != nil {
+        t.Fatal(err)
+    }
+    restored, err := st.Restore(token)
+    if err != nil || restored != s {
+        t.Fatalf("restore failed, %v", err)
+    }
+    if _, err := st.Restore(token); err != gbc.ErrSessionNotFound {
+        t.Fatal("session restored twice")
+    }
+
+    st.Save(s)
+    time.Sleep(time.Millisecond * 20)
+    if _, err := st.Restore(token); err != gbc.ErrSessionNotFound {
+        t.Fatal("expired session restored")
+    }
+}
+
+func TestBasicSessionStoreLimits(t *testing.T) {
+    st := NewBasicSessionStore(time.Minute, 2)
+
+    // token never issued, client can't restore it
+    s := NewBasicSession()
+    if err := st.Save(s); err == nil {
+        t.Fatal("session without token saved")
+    }
+    if s.HasToken() {
+        t.Fatal("token issued by saving")
+    }
+
+    for i := 0; i < 2; i++ {
+        s := NewBasicSession()
+        s.Token()
+        if err := st.Save(s); err != nil {
+            t.Fatal(err)
+        }
+    }
+    s.Token()
+    if err := st.Save(s); err == nil {
+        t.Fatal("full store saved session")
+    }
+}
@@ -0,0 +1,149 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+
+    "github.com/dualface/go-gbc/gbc"
+)
+
+type (
+    subscriber struct {
+        conn gbc.Connection
+        left chan struct{} // closed when unsubscribed
+    }
+
+    BasicTopic struct {
+        // stateless filter for publishing, runs once for all subscribers,
+        // must be same as SharedOutputFilter of subscribers
+        OutputFilter gbc.OutputFilter
+
+        name        string
+        subscribers map[uint64]*subscriber
+        snapshot    atomic.Value // []gbc.Connection, rebuilt after subscribers changed
+        onEmptyFunc func(t *BasicTopic)
+        mutex       *sync.Mutex
+    }
+)
+
+func NewBasicTopic(name string) *BasicTopic {
+    t := &BasicTopic{
+        name:        name,
+        subscribers: make(map[uint64]*subscriber),
+        mutex:       &sync.Mutex{},
+    }
+    t.snapshot.Store([]gbc.Connection{})
+    return t
+}
+
+// interface Topic
+
+func (t *BasicTopic) Name() string {
+    return t.name
+}
+
+func (t *BasicTopic) Subscribe(c gbc.Connection) error {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    _, ok := t.subscribers[c.Id()]
+    if ok {
+        return fmt.Errorf("connection %d already subscribed topic '%s'", c.Id(), t.name)
+    }
+
+    s := &subscriber{
+        conn: c,
+        left: make(chan struct{}),
+    }
+    t.subscribers[c.Id()] = s
+    t.rebuild()
+
+    go t.unsubscribeAfterClosed(s)
+    return nil
+}
+
+func (t *BasicTopic) Unsubscribe(c gbc.Connection) error {
+    t.mutex.Lock()
+    s, ok := t.subscribers[c.Id()]
+    if !ok || s.conn != c {
+        t.mutex.Unlock()
+        return fmt.Errorf("connection %d not subscribed topic '%s'", c.Id(), t.name)
+    }
+
+    close(s.left)
+    delete(t.subscribers, c.Id())
+    t.rebuild()
+    empty := len(t.subscribers) == 0
+    t.mutex.Unlock()
+
+    if empty && t.onEmptyFunc != nil {
+        t.onEmptyFunc(t)
+    }
+    return nil
+}
+
+func (t *BasicTopic) Publish(b []byte) {
+    // no lock and no copy on publishing
+    broadcast(t.snapshot.Load().([]gbc.Connection), b, t.OutputFilter, nil)
+}
+
+func (t *BasicTopic) PublishExcept(b []byte, exclude ...uint64) {
+    broadcast(t.snapshot.Load().([]gbc.Connection), b, t.OutputFilter, exclude)
+}
+
+func (t *BasicTopic) Len() int {
+    return len(t.snapshot.Load().([]gbc.Connection))
+}
+
+// public
+
+// check whether connection subscribed topic
+func (t *BasicTopic) Has(c gbc.Connection) bool {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    s, ok := t.subscribers[c.Id()]
+    return ok && s.conn == c
+}
+
+// private
+
+// must hold mutex
+func (t *BasicTopic) rebuild() {
+    list := make([]gbc.Connection, 0, len(t.subscribers))
+    for _, s := range t.subscribers {
+        list = append(list, s.conn)
+    }
+    t.snapshot.Store(list)
+}
+
+func (t *BasicTopic) unsubscribeAfterClosed(s *subscriber) {
+    select {
+    case <-s.conn.Done():
+        t.Unsubscribe(s.conn)
+    case <-s.left:
+    }
+}
@@ -0,0 +1,149 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "sort"
+    "sync"
+
+    "github.com/dualface/go-gbc/gbc"
+)
+
+type (
+    // named topics, topic is created on first subscribing and removed after last unsubscribing
+    BasicTopicHub struct {
+        topics map[string]*BasicTopic
+        mutex  *sync.Mutex
+    }
+)
+
+func NewBasicTopicHub() *BasicTopicHub {
+    h := &BasicTopicHub{
+        topics: make(map[string]*BasicTopic),
+        mutex:  &sync.Mutex{},
+    }
+    return h
+}
+
+// public
+
+// get topic by name, returns nil if nobody subscribed
+func (h *BasicTopicHub) Topic(name string) *BasicTopic {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    return h.topics[name]
+}
+
+// get names of all topics
+func (h *BasicTopicHub) Topics() []string {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    names := make([]string, 0, len(h.topics))
+    for name := range h.topics {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// get names of topics subscribed by connection
+func (h *BasicTopicHub) Subscriptions(c gbc.Connection) []string {
+    var names []string
+    for _, t := range h.list() {
+        if t.Has(c) {
+            names = append(names, t.Name())
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+func (h *BasicTopicHub) Subscribe(name string, c gbc.Connection) error {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    t, ok := h.topics[name]
+    if !ok {
+        t = NewBasicTopic(name)
+        t.onEmptyFunc = h.removeEmpty
+        h.topics[name] = t
+    }
+    return t.Subscribe(c)
+}
+
+func (h *BasicTopicHub) Unsubscribe(name string, c gbc.Connection) error {
+    t := h.Topic(name)
+    if t == nil {
+        return gbc.ErrConnectionNotFound
+    }
+    return t.Unsubscribe(c)
+}
+
+// unsubscribe connection from all topics
+func (h *BasicTopicHub) UnsubscribeAll(c gbc.Connection) {
+    for _, t := range h.list() {
+        if t.Has(c) {
+            t.Unsubscribe(c)
+        }
+    }
+}
+
+// write bytes to all subscribers of topic
+func (h *BasicTopicHub) Publish(name string, b []byte) {
+    t := h.Topic(name)
+    if t != nil {
+        t.Publish(b)
+    }
+}
+
+// write bytes to all subscribers of topic except specified connections
+func (h *BasicTopicHub) PublishExcept(name string, b []byte, exclude ...uint64) {
+    t := h.Topic(name)
+    if t != nil {
+        t.PublishExcept(b, exclude...)
+    }
+}
+
+// private
+
+func (h *BasicTopicHub) list() []*BasicTopic {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    list := make([]*BasicTopic, 0, len(h.topics))
+    for _, t := range h.topics {
+        list = append(list, t)
+    }
+    return list
+}
+
+func (h *BasicTopicHub) removeEmpty(t *BasicTopic) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    // topic may be subscribed again before removing
+    if h.topics[t.Name()] == t && t.Len() == 0 {
+        delete(h.topics, t.Name())
+    }
+}
@@ -0,0 +1,197 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "context"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc"
+)
+
+type (
+    // client for server-to-server calls, matches replies to requests by request id
+    CommandClient struct {
+        Conn *BasicConnection
+
+        onRawMessageFunc gbc.OnRawMessageFunc
+        lastRequestId    uint32
+        pending          map[uint32]chan *CommandMessage
+        messageChan      chan gbc.RawMessage
+        closed           bool // pending calls have been woken up after connection closed
+        mutex            *sync.Mutex
+    }
+)
+
+func NewCommandClient(c *BasicConnection) *CommandClient {
+    cl := &CommandClient{
+        Conn:        c,
+        pending:     make(map[uint32]chan *CommandMessage),
+        messageChan: make(chan gbc.RawMessage),
+        mutex:       &sync.Mutex{},
+    }
+    c.SetRawMessageChannel(cl.messageChan)
+    return cl
+}
+
+// connect to server and start client
+func DialCommandClient(addr string, timeout time.Duration) (*CommandClient, error) {
+    rawConn, err := net.DialTimeout("tcp", addr, timeout)
+    if err != nil {
+        return nil, err
+    }
+
+    cl := NewCommandClient(NewBasicConnection(rawConn, NewCommandMessageInputFilter()))
+    err = cl.Start()
+    if err != nil {
+        rawConn.Close()
+        return nil, err
+    }
+    return cl, nil
+}
+
+// interface RawMessageReceiverSetter
+
+// set handler function for messages which are not replies
+func (cl *CommandClient) OnRawMessage(f gbc.OnRawMessageFunc) {
+    cl.mutex.Lock()
+    defer cl.mutex.Unlock()
+    cl.onRawMessageFunc = f
+}
+
+// public
+
+func (cl *CommandClient) Start() error {
+    err := cl.Conn.Start()
+    if err != nil {
+        return err
+    }
+    go cl.loop()
+    return nil
+}
+
+func (cl *CommandClient) Close() error {
+    return cl.Conn.Close()
+}
+
+// send request and wait for reply, returns gbc.ErrRequestTimeout if no reply in time
+func (cl *CommandClient) Call(mainCmdId uint16, subCmdId uint16, dataType uint16, data []byte, timeout time.Duration) (*CommandMessage, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    return cl.CallContext(ctx, mainCmdId, subCmdId, dataType, data)
+}
+
+// send request and wait for reply until ctx done, returns gbc.ErrRequestTimeout if deadline exceeded
+func (cl *CommandClient) CallContext(ctx context.Context, mainCmdId uint16, subCmdId uint16, dataType uint16, data []byte) (*CommandMessage, error) {
+    id := atomic.AddUint32(&cl.lastRequestId, 1)
+    reply := make(chan *CommandMessage, 1)
+
+    cl.mutex.Lock()
+    if cl.closed {
+        cl.mutex.Unlock()
+        return nil, gbc.ErrConnectionClosed
+    }
+    cl.pending[id] = reply
+    cl.mutex.Unlock()
+
+    _, err := cl.Conn.Write(NewCommandMessageWithRequestId(mainCmdId, subCmdId, dataType, id, data).GenBytes())
+    if err != nil {
+        cl.forget(id)
+        return nil, err
+    }
+
+    select {
+    case m, ok := <-reply:
+        if !ok {
+            return nil, gbc.ErrConnectionClosed
+        }
+        return m, nil
+
+    case <-ctx.Done():
+        cl.forget(id)
+        if ctx.Err() == context.DeadlineExceeded {
+            return nil, gbc.ErrRequestTimeout
+        }
+        return nil, ctx.Err()
+    }
+}
+
+// send message without waiting for reply
+func (cl *CommandClient) Send(mainCmdId uint16, subCmdId uint16, dataType uint16, data []byte) error {
+    _, err := cl.Conn.Write(NewCommandMessageFromData(mainCmdId, subCmdId, dataType, data).GenBytes())
+    return err
+}
+
+// private
+
+func (cl *CommandClient) loop() {
+    for {
+        select {
+        case m := <-cl.messageChan:
+            cl.dispatch(m)
+
+        case <-cl.Conn.Done():
+            cl.mutex.Lock()
+            cl.closed = true
+            // wake up all waiting calls
+            for id, reply := range cl.pending {
+                close(reply)
+                delete(cl.pending, id)
+            }
+            cl.mutex.Unlock()
+            return
+        }
+    }
+}
+
+func (cl *CommandClient) dispatch(m gbc.RawMessage) {
+    cm, ok := m.(*CommandMessage)
+    if ok && cm.HasRequestId() {
+        cl.mutex.Lock()
+        reply, ok := cl.pending[cm.RequestId()]
+        delete(cl.pending, cm.RequestId())
+        cl.mutex.Unlock()
+
+        if ok {
+            reply <- cm
+            return
+        }
+    }
+
+    cl.mutex.Lock()
+    f := cl.onRawMessageFunc
+    cl.mutex.Unlock()
+
+    if f != nil {
+        f(m)
+    }
+}
+
+func (cl *CommandClient) forget(id uint32) {
+    cl.mutex.Lock()
+    defer cl.mutex.Unlock()
+    delete(cl.pending, id)
+}
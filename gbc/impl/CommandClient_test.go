@@ -0,0 +1,64 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+
+package impl
+
+import (
+    "context"
+    "io"
+    "io/ioutil"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc"
+)
+
+func TestCommandClientCallContext(t *testing.T) {
+    local, remote := net.Pipe()
+    defer remote.Close()
+    // server never replies
+    go io.Copy(ioutil.Discard, remote)
+
+    cl := NewCommandClient(NewBasicConnection(local, NewCommandMessageInputFilter()))
+    if err := cl.Start(); err != nil {
+        t.Fatal(err)
+    }
+    defer cl.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    time.AfterFunc(time.Millisecond*10, cancel)
+    if _, err := cl.CallContext(ctx, 1, 1, CommandMessageProtobufType, nil); err != context.Canceled {
+        t.Fatalf("expected canceled, got %v", err)
+    }
+    if _, err := cl.Call(1, 1, CommandMessageProtobufType, nil, time.Millisecond*10); err != gbc.ErrRequestTimeout {
+        t.Fatalf("expected timeout, got %v", err)
+    }
+
+    cl.mutex.Lock()
+    n := len(cl.pending)
+    cl.mutex.Unlock()
+    if n != 0 {
+        t.Fatalf("%d calls still pending", n)
+    }
+}
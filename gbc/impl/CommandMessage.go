@@ -27,6 +27,8 @@ import (
     "encoding/binary"
     "fmt"
     "strings"
+
+    "github.com/dualface/go-gbc/gbc"
 )
 
 const (
@@ -36,6 +38,10 @@ const (
 
     CommandMessageProtobufType = 1
     CommandMessageClangType    = 2
+
+    // flag bit of DataType, data starts with request id (uint32)
+    CommandMessageRequestIdFlag = 0x8000
+    CommandMessageRequestIdLen  = 4
 )
 
 type (
@@ -48,6 +54,7 @@ type (
         data      []byte
         remains   int
         offset    int
+        conn      gbc.Connection
     }
 )
 
@@ -67,6 +74,10 @@ func NewCommandMessageFromHeaderBuf(buf []byte) (*CommandMessage, error) {
     dataSize := binary.LittleEndian.Uint32(buf[8:12])
     dataType := binary.LittleEndian.Uint16(buf[12:14])
 
+    if dataType&CommandMessageRequestIdFlag != 0 && dataSize < CommandMessageRequestIdLen {
+        return nil, fmt.Errorf("invalid data size for request id")
+    }
+
     checkChunkSize := calcChunkSize(dataSize)
     if checkChunkSize != chunkSize {
         return nil, fmt.Errorf("invalid chunk size or data size")
@@ -86,6 +97,11 @@ func NewCommandMessageFromHeaderBuf(buf []byte) (*CommandMessage, error) {
 }
 
 func NewCommandMessageFromData(mainCmdId uint16, subCmdId uint16, dataType uint16, data []byte) *CommandMessage {
+    if len(data) < CommandMessageRequestIdLen {
+        // too short to carry request id
+        dataType &^= CommandMessageRequestIdFlag
+    }
+
     c := &CommandMessage{}
     c.mainCmdId = mainCmdId
     c.subCmdId = subCmdId
@@ -100,6 +116,22 @@ func NewCommandMessageFromData(mainCmdId uint16, subCmdId uint16, dataType uint1
     return c
 }
 
+// message carries request id, reply of the request has the same request id
+func NewCommandMessageWithRequestId(mainCmdId uint16, subCmdId uint16, dataType uint16, requestId uint32, data []byte) *CommandMessage {
+    buf := make([]byte, CommandMessageRequestIdLen+len(data))
+    binary.LittleEndian.PutUint32(buf, requestId)
+    copy(buf[CommandMessageRequestIdLen:], data)
+    return NewCommandMessageFromData(mainCmdId, subCmdId, dataType|CommandMessageRequestIdFlag, buf)
+}
+
+// reply of request, carries request id of req if it has
+func NewReplyCommandMessage(req *CommandMessage, mainCmdId uint16, subCmdId uint16, dataType uint16, data []byte) *CommandMessage {
+    if !req.HasRequestId() {
+        return NewCommandMessageFromData(mainCmdId, subCmdId, dataType, data)
+    }
+    return NewCommandMessageWithRequestId(mainCmdId, subCmdId, dataType, req.RequestId(), data)
+}
+
 func (m *CommandMessage) WriteBytes(b []byte) (int, error) {
     l := len(b)
     if l > m.remains {
@@ -125,7 +157,38 @@ func (m *CommandMessage) SubCmdId() int {
 }
 
 func (m *CommandMessage) DataType() int {
-    return int(m.dataType)
+    return int(m.dataType &^ CommandMessageRequestIdFlag)
+}
+
+func (m *CommandMessage) HasRequestId() bool {
+    return m.dataType&CommandMessageRequestIdFlag != 0
+}
+
+// returns zero if message doesn't carry request id
+func (m *CommandMessage) RequestId() uint32 {
+    if !m.HasRequestId() {
+        return 0
+    }
+    return binary.LittleEndian.Uint32(m.data[0:CommandMessageRequestIdLen])
+}
+
+// write reply with same command id and request id to the connection which message comes from
+func (m *CommandMessage) Reply(dataType uint16, data []byte) error {
+    return m.ReplyCommand(m.mainCmdId, m.subCmdId, dataType, data)
+}
+
+// write reply with request id to the connection which message comes from
+func (m *CommandMessage) ReplyCommand(mainCmdId uint16, subCmdId uint16, dataType uint16, data []byte) error {
+    if m.conn == nil {
+        return fmt.Errorf("message %d:%d not comes from connection", m.mainCmdId, m.subCmdId)
+    }
+
+    b := NewReplyCommandMessage(m, mainCmdId, subCmdId, dataType, data).GenBytes()
+    if w, ok := m.conn.(gbc.AsyncWriter); ok {
+        return w.Enqueue(b)
+    }
+    _, err := m.conn.Write(b)
+    return err
 }
 
 func (m *CommandMessage) GenBytes() []byte {
@@ -144,9 +207,22 @@ func (m *CommandMessage) GenBytes() []byte {
 // interface CommandMessage
 
 func (m *CommandMessage) DataBytes() []byte {
+    if m.HasRequestId() {
+        return m.data[CommandMessageRequestIdLen:m.dataSize]
+    }
     return m.data[:m.dataSize]
 }
 
+// interface ConnectionRawMessage
+
+func (m *CommandMessage) Connection() gbc.Connection {
+    return m.conn
+}
+
+func (m *CommandMessage) SetConnection(c gbc.Connection) {
+    m.conn = c
+}
+
 // interface String
 
 func (m *CommandMessage) String() string {
@@ -0,0 +1,59 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+
+package impl
+
+import (
+    "testing"
+)
+
+func TestCommandMessageRequestId(t *testing.T) {
+    m := NewCommandMessageWithRequestId(1, 2, CommandMessageProtobufType, 7, []byte("hi"))
+    if !m.HasRequestId() || m.RequestId() != 7 || string(m.DataBytes()) != "hi" || m.DataType() != CommandMessageProtobufType {
+        t.Fatalf("invalid message %s", m)
+    }
+
+    // parsed message keeps request id
+    b := m.GenBytes()
+    p, err := NewCommandMessageFromHeaderBuf(b[:CommandMessageHeaderLen])
+    if err != nil {
+        t.Fatal(err)
+    }
+    p.WriteBytes(b[CommandMessageHeaderLen:])
+    if p.RequestId() != 7 || string(p.DataBytes()) != "hi" {
+        t.Fatalf("invalid parsed message %s", p)
+    }
+
+    // flag without enough data for request id
+    m = NewCommandMessageFromData(1, 2, CommandMessageProtobufType|CommandMessageRequestIdFlag, []byte("hi"))
+    if m.HasRequestId() || m.RequestId() != 0 || string(m.DataBytes()) != "hi" {
+        t.Fatalf("invalid message %s", m)
+    }
+
+    header := NewCommandMessageFromData(1, 2, CommandMessageProtobufType, []byte("hi")).GenBytes()[:CommandMessageHeaderLen]
+    // high byte of little endian data type
+    header[CommandMessageHeaderLen-1] |= CommandMessageRequestIdFlag >> 8
+    if _, err := NewCommandMessageFromHeaderBuf(header); err == nil {
+        t.Fatal("parsed header with request id flag and short data")
+    }
+}
@@ -23,24 +23,100 @@
 package impl
 
 import (
+    "fmt"
+    "reflect"
+    "sync"
+
+    "github.com/dualface/go-cli-colorlog"
     "github.com/dualface/go-gbc/gbc"
 )
 
+const (
+    DefaultPendingMessageLimit = 1024
+)
+
 type (
+    // messages with same key are handled sequentially, nil key means message can be handled in any order
+    MessageKeyFunc func(m gbc.RawMessage) interface{}
+
+    // pending messages of a key, at most one worker handles it at a time
+    keyedMessages struct {
+        key      interface{}
+        messages []gbc.RawMessage
+    }
+
     ConcurrenceMessageHandler struct {
-        semaphore        chan int
+        // drop message and return gbc.ErrPendingMessagesFull when pending messages reach the limit,
+        // otherwise ReceiveRawMessage() waits until a pending message handled, set before receiving
+        DropWhenFull bool
+
+        keyFunc          MessageKeyFunc
         onRawMessageFunc gbc.OnRawMessageFunc
+        slots            chan struct{} // limit pending messages
+        tasks            chan *keyedMessages
+        keys             map[interface{}]*keyedMessages
+        done             chan struct{}
+        closed           bool
+        mutex            *sync.Mutex
     }
 )
 
+// key of message is id of connection it comes from
+func ConnectionMessageKey(m gbc.RawMessage) interface{} {
+    cm, ok := m.(gbc.ConnectionRawMessage)
+    if !ok || cm.Connection() == nil {
+        return nil
+    }
+    return cm.Connection().Id()
+}
+
+// key of message is session value of connection it comes from, e.g. player id, room id,
+// value can't be used as map key (e.g. slice, map) falls back to id of connection
+func SessionMessageKey(name string) MessageKeyFunc {
+    return func(m gbc.RawMessage) interface{} {
+        cm, ok := m.(gbc.ConnectionRawMessage)
+        if !ok || cm.Connection() == nil || cm.Connection().Session() == nil {
+            return nil
+        }
+        v, ok := cm.Connection().Session().Get(name)
+        if !ok || v == nil {
+            return nil
+        }
+        if !reflect.TypeOf(v).Comparable() {
+            return cm.Connection().Id()
+        }
+        return v
+    }
+}
+
+// messages are handled in any order, ReceiveRawMessage() waits when too many messages are pending
 func NewConcurrenceMessageHandler(concurrence int, f gbc.OnRawMessageFunc) *ConcurrenceMessageHandler {
+    return NewKeyedConcurrenceMessageHandler(concurrence, 0, nil, f)
+}
+
+// messages with same key are handled in order, different keys in parallel,
+// ReceiveRawMessage() waits when pendingLimit messages are pending, unless DropWhenFull is set
+func NewKeyedConcurrenceMessageHandler(concurrence int, pendingLimit int, key MessageKeyFunc, f gbc.OnRawMessageFunc) *ConcurrenceMessageHandler {
     if concurrence <= 1 {
         concurrence = 1
     }
+    if pendingLimit < 1 {
+        pendingLimit = DefaultPendingMessageLimit
+    }
 
     r := &ConcurrenceMessageHandler{
-        semaphore:        make(chan int, concurrence),
+        keyFunc:          key,
         onRawMessageFunc: f,
+        slots:            make(chan struct{}, pendingLimit),
+        // each task holds at least one pending message, so sending task never blocks
+        tasks: make(chan *keyedMessages, pendingLimit),
+        keys:  make(map[interface{}]*keyedMessages),
+        done:  make(chan struct{}),
+        mutex: &sync.Mutex{},
+    }
+
+    for i := 0; i < concurrence; i++ {
+        go r.work()
     }
 
     return r
@@ -49,11 +125,114 @@ func NewConcurrenceMessageHandler(concurrence int, f gbc.OnRawMessageFunc) *Conc
 // interface RawMessageReceiver
 
 func (r *ConcurrenceMessageHandler) ReceiveRawMessage(m gbc.RawMessage) error {
-    // avoid blocking caller
-    go func() {
-        r.semaphore <- 1
-        r.onRawMessageFunc(m)
-        <-r.semaphore
-    }()
+    select {
+    case <-r.done:
+        return fmt.Errorf("message handler is closed")
+    default:
+    }
+
+    select {
+    case r.slots <- struct{}{}:
+    default:
+        if r.DropWhenFull {
+            clog.PrintWarn("message handler has %d pending messages, drop message", cap(r.slots))
+            return gbc.ErrPendingMessagesFull
+        }
+
+        // slow down caller until a pending message handled
+        select {
+        case r.slots <- struct{}{}:
+        case <-r.done:
+            return fmt.Errorf("message handler is closed")
+        }
+    }
+
+    var key interface{}
+    if r.keyFunc != nil {
+        key = r.keyFunc(m)
+    }
+
+    r.mutex.Lock()
+    if r.closed {
+        r.mutex.Unlock()
+        <-r.slots
+        return fmt.Errorf("message handler is closed")
+    }
+
+    if key != nil {
+        if t, ok := r.keys[key]; ok {
+            // worker of the key will handle it later
+            t.messages = append(t.messages, m)
+            r.mutex.Unlock()
+            return nil
+        }
+    }
+
+    t := &keyedMessages{key: key, messages: []gbc.RawMessage{m}}
+    if key != nil {
+        r.keys[key] = t
+    }
+    r.tasks <- t
+    r.mutex.Unlock()
     return nil
 }
+
+// public
+
+// number of messages waiting or being handled
+func (r *ConcurrenceMessageHandler) Pending() int {
+    return len(r.slots)
+}
+
+// stop workers, pending messages are dropped
+func (r *ConcurrenceMessageHandler) Close() error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    if r.closed {
+        return nil
+    }
+    r.closed = true
+    close(r.done)
+    return nil
+}
+
+// private
+
+func (r *ConcurrenceMessageHandler) work() {
+    for {
+        select {
+        case t := <-r.tasks:
+            r.handle(t)
+
+        case <-r.done:
+            return
+        }
+    }
+}
+
+func (r *ConcurrenceMessageHandler) handle(t *keyedMessages) {
+    r.mutex.Lock()
+    m := t.messages[0]
+    r.mutex.Unlock()
+
+    r.onRawMessageFunc(m)
+    <-r.slots
+
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    t.messages[0] = nil
+    t.messages = t.messages[1:]
+    if len(t.messages) == 0 {
+        if t.key != nil {
+            delete(r.keys, t.key)
+        }
+        return
+    }
+
+    // requeue, let other keys have a chance
+    if !r.closed {
+        r.tasks <- t
+    }
+}
@@ -0,0 +1,143 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc"
+)
+
+func TestConcurrenceMessageHandlerKeyed(t *testing.T) {
+    const (
+        keys  = 4
+        count = 20
+    )
+
+    var mutex sync.Mutex
+    last := make(map[uint64]int)
+    var active, maxActive int32
+    var wg sync.WaitGroup
+    h := NewKeyedConcurrenceMessageHandler(keys, 8, ConnectionMessageKey, func(m gbc.RawMessage) error {
+        defer wg.Done()
+        n := atomic.AddInt32(&active, 1)
+        defer atomic.AddInt32(&active, -1)
+        for {
+            max := atomic.LoadInt32(&maxActive)
+            if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+                break
+            }
+        }
+        time.Sleep(time.Millisecond)
+
+        cm := m.(*CommandMessage)
+        id := cm.Connection().Id()
+        mutex.Lock()
+        defer mutex.Unlock()
+        if last[id] != cm.SubCmdId()-1 {
+            t.Errorf("connection %d handled %d after %d", id, cm.SubCmdId(), last[id])
+        }
+        last[id] = cm.SubCmdId()
+        return nil
+    })
+    defer h.Close()
+
+    var conns []*BasicConnection
+    for i := 0; i < keys; i++ {
+        c, remote, _ := newTestConnection()
+        defer remote.Close()
+        conns = append(conns, c)
+    }
+
+    // more messages than pending limit, waits instead of dropping
+    for seq := 1; seq <= count; seq++ {
+        for _, c := range conns {
+            m := NewCommandMessageFromData(1, uint16(seq), CommandMessageClangType, nil)
+            m.SetConnection(c)
+            wg.Add(1)
+            if err := h.ReceiveRawMessage(m); err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+    wg.Wait()
+
+    for _, c := range conns {
+        if last[c.Id()] != count {
+            t.Fatalf("connection %d handled %d messages", c.Id(), last[c.Id()])
+        }
+    }
+    if atomic.LoadInt32(&maxActive) < 2 {
+        t.Fatal("different keys are not handled in parallel")
+    }
+}
+
+func TestConcurrenceMessageHandlerFull(t *testing.T) {
+    release := make(chan struct{})
+    f := func(gbc.RawMessage) error {
+        <-release
+        return nil
+    }
+
+    drop := NewKeyedConcurrenceMessageHandler(1, 1, nil, f)
+    drop.DropWhenFull = true
+    defer drop.Close()
+    if err := drop.ReceiveRawMessage(NewCommandMessageFromData(1, 1, CommandMessageClangType, nil)); err != nil {
+        t.Fatal(err)
+    }
+    if err := drop.ReceiveRawMessage(NewCommandMessageFromData(1, 2, CommandMessageClangType, nil)); err != gbc.ErrPendingMessagesFull {
+        t.Fatalf("expected full, got %v", err)
+    }
+
+    // legacy handler never drops
+    h := NewConcurrenceMessageHandler(1, f)
+    for i := 0; i < DefaultPendingMessageLimit; i++ {
+        h.ReceiveRawMessage(NewCommandMessageFromData(1, 1, CommandMessageClangType, nil))
+    }
+    received := make(chan error, 1)
+    go func() {
+        received <- h.ReceiveRawMessage(NewCommandMessageFromData(1, 2, CommandMessageClangType, nil))
+    }()
+    select {
+    case err := <-received:
+        t.Fatalf("not waiting for pending messages, %v", err)
+    case <-time.After(time.Millisecond * 20):
+    }
+
+    close(release)
+    select {
+    case err := <-received:
+        if err != nil {
+            t.Fatal(err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("message not received after pending messages handled")
+    }
+    h.Close()
+    if err := h.ReceiveRawMessage(NewCommandMessageFromData(1, 3, CommandMessageClangType, nil)); err == nil {
+        t.Fatal("received by closed handler")
+    }
+}
@@ -0,0 +1,299 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "context"
+    "fmt"
+    "sync/atomic"
+
+    "github.com/dualface/go-cli-colorlog"
+    "github.com/dualface/go-gbc/gbc"
+)
+
+const (
+    // control messages, heartbeat
+    MessagePriorityHigh MessagePriority = iota
+    // gameplay messages
+    MessagePriorityNormal
+    // statistics, chat history
+    MessagePriorityLow
+
+    messagePriorityCount = 3
+)
+
+const (
+    // wait until queue has space, slow down reading of connection
+    OverflowPolicyBlock OverflowPolicy = iota
+    // drop the incoming message
+    OverflowPolicyDropNewest
+    // drop the oldest message in queue, then push the incoming message
+    OverflowPolicyDropOldest
+    // drop the incoming message and close its connection
+    OverflowPolicyDisconnect
+)
+
+const (
+    DefaultMessageQueueSize = 1024
+)
+
+type (
+    MessagePriority int
+
+    OverflowPolicy int
+
+    MessagePriorityFunc func(m gbc.RawMessage) MessagePriority
+
+    MessageLaneStats struct {
+        Depth    int
+        MaxDepth int64
+        Enqueued uint64
+        Dropped  uint64
+    }
+
+    MessageQueueStats struct {
+        // capacity of each lane
+        Capacity     int
+        Lanes        [messagePriorityCount]MessageLaneStats
+        Processed    uint64
+        Disconnected uint64
+    }
+
+    // 64-bit fields updated atomically must be first, so they are aligned on 32-bit platforms
+    messageLane struct {
+        maxDepth int64
+        enqueued uint64
+        dropped  uint64
+        messages chan gbc.RawMessage
+    }
+
+    // bounded queue with priority lanes, only one goroutine pushes and one goroutine pops
+    MessageQueue struct {
+        processed    uint64
+        disconnected uint64
+
+        Policy OverflowPolicy
+
+        lanes    [messagePriorityCount]*messageLane
+        capacity int
+        // called with message which never be popped, include dropped old message
+        onDiscard func(m gbc.RawMessage)
+    }
+)
+
+func (p MessagePriority) String() string {
+    switch p {
+    case MessagePriorityHigh:
+        return "high"
+    case MessagePriorityNormal:
+        return "normal"
+    case MessagePriorityLow:
+        return "low"
+    default:
+        return fmt.Sprintf("unknown(%d)", int(p))
+    }
+}
+
+func (p OverflowPolicy) String() string {
+    switch p {
+    case OverflowPolicyBlock:
+        return "block"
+    case OverflowPolicyDropNewest:
+        return "drop-newest"
+    case OverflowPolicyDropOldest:
+        return "drop-oldest"
+    case OverflowPolicyDisconnect:
+        return "disconnect"
+    default:
+        return fmt.Sprintf("unknown(%d)", int(p))
+    }
+}
+
+// priority of commands, use AnySubCmdId to match all sub commands, unmatched messages are normal
+func NewCommandPriorityFunc(priorities map[CommandId]MessagePriority) MessagePriorityFunc {
+    return func(m gbc.RawMessage) MessagePriority {
+        cmd, ok := m.(commandMessage)
+        if !ok {
+            return MessagePriorityNormal
+        }
+
+        p, ok := priorities[CommandId{cmd.MainCmdId(), cmd.SubCmdId()}]
+        if !ok {
+            p, ok = priorities[CommandId{cmd.MainCmdId(), AnySubCmdId}]
+        }
+        if !ok {
+            return MessagePriorityNormal
+        }
+        return p
+    }
+}
+
+func NewMessageQueue(capacity int, policy OverflowPolicy) *MessageQueue {
+    if capacity < 1 {
+        capacity = DefaultMessageQueueSize
+    }
+
+    q := &MessageQueue{
+        Policy:   policy,
+        capacity: capacity,
+    }
+    for i := range q.lanes {
+        q.lanes[i] = &messageLane{messages: make(chan gbc.RawMessage, capacity)}
+    }
+    return q
+}
+
+// public
+
+// push message to lane, returns false if message dropped or ctx done
+func (q *MessageQueue) Push(ctx context.Context, m gbc.RawMessage, p MessagePriority) bool {
+    if p < MessagePriorityHigh || p > MessagePriorityLow {
+        p = MessagePriorityNormal
+    }
+    lane := q.lanes[p]
+
+    select {
+    case lane.messages <- m:
+        lane.pushed()
+        return true
+    default:
+    }
+
+    // lane is full
+    switch q.Policy {
+    case OverflowPolicyDropNewest:
+        q.drop(lane, m)
+        return false
+
+    case OverflowPolicyDropOldest:
+        select {
+        case old := <-lane.messages:
+            q.drop(lane, old)
+        default:
+        }
+        select {
+        case lane.messages <- m:
+            lane.pushed()
+            return true
+        default:
+            q.drop(lane, m)
+            return false
+        }
+
+    case OverflowPolicyDisconnect:
+        q.drop(lane, m)
+        if cm, ok := m.(gbc.ConnectionRawMessage); ok && cm.Connection() != nil {
+            atomic.AddUint64(&q.disconnected, 1)
+            c := cm.Connection()
+            clog.PrintWarn("message queue of %s priority is full, close connection %d", p, c.Id())
+            // connection waits for the message being forwarded, so close it in other goroutine
+            go c.Close()
+        }
+        return false
+
+    default:
+        select {
+        case lane.messages <- m:
+            lane.pushed()
+            return true
+        case <-ctx.Done():
+            q.discard(m)
+            return false
+        }
+    }
+}
+
+// pop message of highest priority, returns false if ctx done
+func (q *MessageQueue) Pop(ctx context.Context) (gbc.RawMessage, bool) {
+    for _, lane := range q.lanes {
+        select {
+        case m := <-lane.messages:
+            atomic.AddUint64(&q.processed, 1)
+            return m, true
+        default:
+        }
+    }
+
+    select {
+    case m := <-q.lanes[MessagePriorityHigh].messages:
+        atomic.AddUint64(&q.processed, 1)
+        return m, true
+    case m := <-q.lanes[MessagePriorityNormal].messages:
+        atomic.AddUint64(&q.processed, 1)
+        return m, true
+    case m := <-q.lanes[MessagePriorityLow].messages:
+        atomic.AddUint64(&q.processed, 1)
+        return m, true
+    case <-ctx.Done():
+        return nil, false
+    }
+}
+
+func (q *MessageQueue) Len() int {
+    n := 0
+    for _, lane := range q.lanes {
+        n += len(lane.messages)
+    }
+    return n
+}
+
+func (q *MessageQueue) Stats() MessageQueueStats {
+    s := MessageQueueStats{
+        Capacity:     q.capacity,
+        Processed:    atomic.LoadUint64(&q.processed),
+        Disconnected: atomic.LoadUint64(&q.disconnected),
+    }
+    for i, lane := range q.lanes {
+        s.Lanes[i] = MessageLaneStats{
+            Depth:    len(lane.messages),
+            MaxDepth: atomic.LoadInt64(&lane.maxDepth),
+            Enqueued: atomic.LoadUint64(&lane.enqueued),
+            Dropped:  atomic.LoadUint64(&lane.dropped),
+        }
+    }
+    return s
+}
+
+// private
+
+func (q *MessageQueue) drop(lane *messageLane, m gbc.RawMessage) {
+    atomic.AddUint64(&lane.dropped, 1)
+    q.discard(m)
+}
+
+func (q *MessageQueue) discard(m gbc.RawMessage) {
+    if q.onDiscard != nil {
+        q.onDiscard(m)
+    }
+}
+
+func (l *messageLane) pushed() {
+    atomic.AddUint64(&l.enqueued, 1)
+    depth := int64(len(l.messages))
+    for {
+        max := atomic.LoadInt64(&l.maxDepth)
+        if depth <= max || atomic.CompareAndSwapInt64(&l.maxDepth, max, depth) {
+            return
+        }
+    }
+}
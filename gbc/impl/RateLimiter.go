@@ -0,0 +1,342 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "fmt"
+    "sync/atomic"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc"
+)
+
+const (
+    // drop the message
+    RateLimitActionDrop RateLimitAction = iota
+    // hold the message until tokens available, slow down reading of connection,
+    // message needs more tokens than Burst is dropped
+    RateLimitActionDelay
+    // close the connection
+    RateLimitActionDisconnect
+    // deliver the message, only report violation
+    RateLimitActionReport
+)
+
+const (
+    // match all sub commands of main command
+    AnySubCmdId = -1
+)
+
+type (
+    RateLimitAction int
+
+    // refill Rate tokens per second, hold Burst tokens at most, zero Rate means unlimited,
+    // zero Burst means Rate but at least 1, message needs more tokens than Burst is always rejected
+    RateLimit struct {
+        Rate  float64
+        Burst float64
+    }
+
+    CommandId struct {
+        MainCmdId int
+        SubCmdId  int
+    }
+
+    RateLimitViolation struct {
+        // "messages", "bytes" or "command"
+        Limit     string
+        MainCmdId int
+        SubCmdId  int
+        Action    RateLimitAction
+        // gbc.ErrRateLimitExceeded, or gbc.ErrRateLimitBurstExceeded if message can never pass
+        Err error
+    }
+
+    OnRateLimitViolationFunc func(c gbc.Connection, v RateLimitViolation)
+
+    RateLimitStats struct {
+        Passed       uint64
+        Violated     uint64
+        Dropped      uint64
+        Delayed      uint64
+        Disconnected uint64
+    }
+
+    // shared by connections, counts violations of all connections
+    RateLimitPolicy struct {
+        // updated atomically, must be first to be aligned on 32-bit platforms
+        stats RateLimitStats
+
+        // messages per second
+        Messages RateLimit
+        // bytes of message data per second
+        Bytes RateLimit
+        // messages per second of specified commands
+        Commands map[CommandId]RateLimit
+        // action on violation
+        Action RateLimitAction
+        // called in its own goroutine on violation, include delaying
+        OnViolation OnRateLimitViolationFunc
+    }
+
+    TokenBucket struct {
+        limit  RateLimit
+        tokens float64
+        last   time.Time
+    }
+
+    // per-connection limiter, not thread-safe
+    RateLimiter struct {
+        stats    RateLimitStats // first for atomic alignment
+        policy   *RateLimitPolicy
+        messages *TokenBucket
+        bytes    *TokenBucket
+        commands map[CommandId]*TokenBucket
+    }
+
+    commandMessage interface {
+        MainCmdId() int
+        SubCmdId() int
+    }
+
+    rateLimitCheck struct {
+        limit  string
+        bucket *TokenBucket
+        n      float64
+    }
+)
+
+func (a RateLimitAction) String() string {
+    switch a {
+    case RateLimitActionDrop:
+        return "drop"
+    case RateLimitActionDelay:
+        return "delay"
+    case RateLimitActionDisconnect:
+        return "disconnect"
+    case RateLimitActionReport:
+        return "report"
+    default:
+        return fmt.Sprintf("unknown(%d)", int(a))
+    }
+}
+
+// public
+
+func (p *RateLimitPolicy) Stats() RateLimitStats {
+    return p.stats.load()
+}
+
+func NewTokenBucket(limit RateLimit) *TokenBucket {
+    if limit.Burst <= 0 {
+        limit.Burst = limit.Rate
+    }
+    if limit.Burst < 1 {
+        limit.Burst = 1
+    }
+
+    b := &TokenBucket{
+        limit:  limit,
+        tokens: limit.Burst,
+        last:   time.Now(),
+    }
+    return b
+}
+
+// check whether n tokens can be taken now, tokens are not taken
+func (b *TokenBucket) Check(n float64, now time.Time) error {
+    if b.limit.Rate <= 0 {
+        return nil
+    }
+    if n > b.limit.Burst {
+        return gbc.ErrRateLimitBurstExceeded
+    }
+
+    b.refill(now)
+    if b.tokens < n {
+        return gbc.ErrRateLimitExceeded
+    }
+    return nil
+}
+
+// take n tokens if enough
+func (b *TokenBucket) Take(n float64, now time.Time) error {
+    err := b.Check(n, now)
+    if err == nil && b.limit.Rate > 0 {
+        b.tokens -= n
+    }
+    return err
+}
+
+// take n tokens in advance, returns duration to wait until tokens available
+func (b *TokenBucket) Reserve(n float64, now time.Time) time.Duration {
+    if b.limit.Rate <= 0 {
+        return 0
+    }
+
+    b.refill(now)
+    b.tokens -= n
+    if b.tokens >= 0 {
+        return 0
+    }
+    return time.Duration(-b.tokens / b.limit.Rate * float64(time.Second))
+}
+
+func NewRateLimiter(policy *RateLimitPolicy) *RateLimiter {
+    l := &RateLimiter{
+        policy:   policy,
+        messages: NewTokenBucket(policy.Messages),
+        bytes:    NewTokenBucket(policy.Bytes),
+        commands: make(map[CommandId]*TokenBucket, len(policy.Commands)),
+    }
+    for id, limit := range policy.Commands {
+        l.commands[id] = NewTokenBucket(limit)
+    }
+    return l
+}
+
+// check message, returns duration to wait before delivering, and violation if limit exceeded,
+// violation with RateLimitActionDelay is reported only, message is delivered after waiting
+func (l *RateLimiter) Allow(m gbc.RawMessage) (time.Duration, *RateLimitViolation) {
+    now := time.Now()
+    size := float64(len(m.DataBytes()))
+
+    v := &RateLimitViolation{Action: l.policy.Action}
+    checks := make([]rateLimitCheck, 0, 3)
+    cmd, ok := m.(commandMessage)
+    if ok {
+        v.MainCmdId = cmd.MainCmdId()
+        v.SubCmdId = cmd.SubCmdId()
+        b := l.commands[CommandId{v.MainCmdId, v.SubCmdId}]
+        if b == nil {
+            b = l.commands[CommandId{v.MainCmdId, AnySubCmdId}]
+        }
+        if b != nil {
+            checks = append(checks, rateLimitCheck{limit: "command", bucket: b, n: 1})
+        }
+    }
+    checks = append(checks,
+        rateLimitCheck{limit: "messages", bucket: l.messages, n: 1},
+        rateLimitCheck{limit: "bytes", bucket: l.bytes, n: size},
+    )
+
+    if l.policy.Action == RateLimitActionDelay {
+        v.Limit, v.Err = checkBurst(checks)
+        if v.Err != nil {
+            // waiting never makes enough tokens
+            v.Action = RateLimitActionDrop
+            l.count(func(s *RateLimitStats) *uint64 { return &s.Violated })
+            l.count(func(s *RateLimitStats) *uint64 { return &s.Dropped })
+            return 0, v
+        }
+
+        var wait time.Duration
+        for _, c := range checks {
+            if w := c.bucket.Reserve(c.n, now); w > wait {
+                wait = w
+                v.Limit = c.limit
+            }
+        }
+        if wait <= 0 {
+            l.count(func(s *RateLimitStats) *uint64 { return &s.Passed })
+            return 0, nil
+        }
+        v.Err = gbc.ErrRateLimitExceeded
+        l.count(func(s *RateLimitStats) *uint64 { return &s.Violated })
+        l.count(func(s *RateLimitStats) *uint64 { return &s.Delayed })
+        return wait, v
+    }
+
+    v.Limit, v.Err = takeAll(checks, now)
+    if v.Err == nil {
+        l.count(func(s *RateLimitStats) *uint64 { return &s.Passed })
+        return 0, nil
+    }
+
+    l.count(func(s *RateLimitStats) *uint64 { return &s.Violated })
+    switch v.Action {
+    case RateLimitActionDrop:
+        l.count(func(s *RateLimitStats) *uint64 { return &s.Dropped })
+    case RateLimitActionDisconnect:
+        l.count(func(s *RateLimitStats) *uint64 { return &s.Disconnected })
+    }
+    return 0, v
+}
+
+func (l *RateLimiter) Stats() RateLimitStats {
+    return l.stats.load()
+}
+
+// private
+
+// returns limit and gbc.ErrRateLimitBurstExceeded if message needs more tokens than burst of any bucket
+func checkBurst(checks []rateLimitCheck) (string, error) {
+    for _, c := range checks {
+        if c.bucket.limit.Rate > 0 && c.n > c.bucket.limit.Burst {
+            return c.limit, gbc.ErrRateLimitBurstExceeded
+        }
+    }
+    return "", nil
+}
+
+// take tokens from all buckets only if all have enough, returns limit and error of first rejecting bucket
+func takeAll(checks []rateLimitCheck, now time.Time) (string, error) {
+    for _, c := range checks {
+        if err := c.bucket.Check(c.n, now); err != nil {
+            return c.limit, err
+        }
+    }
+    for _, c := range checks {
+        c.bucket.Take(c.n, now)
+    }
+    return "", nil
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+    elapsed := now.Sub(b.last).Seconds()
+    b.last = now
+    if elapsed <= 0 {
+        return
+    }
+
+    b.tokens += elapsed * b.limit.Rate
+    if b.tokens > b.limit.Burst {
+        b.tokens = b.limit.Burst
+    }
+}
+
+// counters can be read from other goroutines
+func (l *RateLimiter) count(field func(s *RateLimitStats) *uint64) {
+    atomic.AddUint64(field(&l.stats), 1)
+    atomic.AddUint64(field(&l.policy.stats), 1)
+}
+
+func (s *RateLimitStats) load() RateLimitStats {
+    return RateLimitStats{
+        Passed:       atomic.LoadUint64(&s.Passed),
+        Violated:     atomic.LoadUint64(&s.Violated),
+        Dropped:      atomic.LoadUint64(&s.Dropped),
+        Delayed:      atomic.LoadUint64(&s.Delayed),
+        Disconnected: atomic.LoadUint64(&s.Disconnected),
+    }
+}
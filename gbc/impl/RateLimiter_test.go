@@ -0,0 +1,155 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "testing"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc"
+)
+
+func TestTokenBucketBurst(t *testing.T) {
+    tests := []struct {
+        limit RateLimit
+        burst float64
+    }{
+        {RateLimit{Rate: 5}, 5},
+        {RateLimit{Rate: 0.5}, 1},
+        {RateLimit{Rate: 5, Burst: 2}, 2},
+        {RateLimit{Rate: 5, Burst: 20}, 20},
+    }
+    for _, test := range tests {
+        b := NewTokenBucket(test.limit)
+        if b.limit.Burst != test.burst || b.tokens != test.burst {
+            t.Errorf("%+v: burst %v, tokens %v, expected %v", test.limit, b.limit.Burst, b.tokens, test.burst)
+        }
+    }
+}
+
+func TestTokenBucketTake(t *testing.T) {
+    b := NewTokenBucket(RateLimit{Rate: 10, Burst: 3})
+    now := b.last
+
+    for i := 0; i < 3; i++ {
+        if err := b.Take(1, now); err != nil {
+            t.Fatalf("take %d, %s", i, err)
+        }
+    }
+    if err := b.Take(1, now); err != gbc.ErrRateLimitExceeded {
+        t.Fatalf("take from empty bucket, %v", err)
+    }
+
+    // refill 1 token per 100ms, never more than burst
+    now = now.Add(time.Millisecond * 100)
+    if err := b.Check(1, now); err != nil {
+        t.Fatal(err)
+    }
+    if err := b.Check(1, now); err != nil {
+        t.Fatal("check takes tokens")
+    }
+    now = now.Add(time.Hour)
+    if err := b.Take(3, now); err != nil {
+        t.Fatal(err)
+    }
+    if err := b.Take(1, now); err != gbc.ErrRateLimitExceeded {
+        t.Fatalf("bucket refilled over burst, %v", err)
+    }
+
+    if err := b.Take(4, now.Add(time.Hour)); err != gbc.ErrRateLimitBurstExceeded {
+        t.Fatalf("take more than burst, %v", err)
+    }
+
+    unlimited := NewTokenBucket(RateLimit{})
+    if err := unlimited.Take(1000, now); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+    b := NewTokenBucket(RateLimit{Rate: 10, Burst: 2})
+    now := b.last
+
+    if w := b.Reserve(2, now); w != 0 {
+        t.Fatalf("wait %s", w)
+    }
+    if w := b.Reserve(1, now); w != time.Millisecond*100 {
+        t.Fatalf("wait %s", w)
+    }
+    if w := b.Reserve(1, now); w != time.Millisecond*200 {
+        t.Fatalf("wait %s", w)
+    }
+}
+
+func TestRateLimiterTakeAll(t *testing.T) {
+    l := NewRateLimiter(&RateLimitPolicy{
+        Bytes:    RateLimit{Rate: 100, Burst: 100},
+        Commands: map[CommandId]RateLimit{{1, AnySubCmdId}: {Rate: 1, Burst: 1}},
+        Action:   RateLimitActionDrop,
+    })
+
+    // rejected by bytes, command bucket is not debited
+    _, v := l.Allow(NewCommandMessageFromData(1, 1, 0, make([]byte, 200)))
+    if v == nil || v.Limit != "bytes" || v.Err != gbc.ErrRateLimitBurstExceeded {
+        t.Fatalf("violation %+v", v)
+    }
+    if _, v := l.Allow(NewCommandMessageFromData(1, 2, 0, make([]byte, 10))); v != nil {
+        t.Fatalf("violation %+v", v)
+    }
+    _, v = l.Allow(NewCommandMessageFromData(1, 1, 0, nil))
+    if v == nil || v.Limit != "command" || v.Err != gbc.ErrRateLimitExceeded || v.MainCmdId != 1 {
+        t.Fatalf("violation %+v", v)
+    }
+
+    stats := l.Stats()
+    if stats.Passed != 1 || stats.Violated != 2 || stats.Dropped != 2 {
+        t.Fatalf("stats %+v", stats)
+    }
+}
+
+func TestRateLimiterDelay(t *testing.T) {
+    l := NewRateLimiter(&RateLimitPolicy{
+        Messages: RateLimit{Rate: 10, Burst: 1},
+        Bytes:    RateLimit{Rate: 100, Burst: 100},
+        Action:   RateLimitActionDelay,
+    })
+
+    // never passes, dropped instead of waiting
+    wait, v := l.Allow(NewCommandMessageFromData(1, 1, 0, make([]byte, 1000)))
+    if wait != 0 || v == nil || v.Err != gbc.ErrRateLimitBurstExceeded || v.Action != RateLimitActionDrop {
+        t.Fatalf("wait %s, violation %+v", wait, v)
+    }
+
+    if wait, v := l.Allow(NewCommandMessageFromData(1, 1, 0, nil)); wait != 0 || v != nil {
+        t.Fatalf("wait %s, violation %+v", wait, v)
+    }
+    wait, v = l.Allow(NewCommandMessageFromData(1, 1, 0, nil))
+    if wait <= 0 || v == nil || v.Action != RateLimitActionDelay || v.Limit != "messages" || v.Err != gbc.ErrRateLimitExceeded {
+        t.Fatalf("wait %s, violation %+v", wait, v)
+    }
+
+    stats := l.Stats()
+    if stats.Passed != 1 || stats.Violated != 2 || stats.Dropped != 1 || stats.Delayed != 1 {
+        t.Fatalf("stats %+v", stats)
+    }
+}
@@ -0,0 +1,87 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "fmt"
+)
+
+type (
+    // keep recent outbound messages with sequence numbers, not thread-safe
+    ReplayBuffer struct {
+        entries [][]byte
+        head    int    // index of the oldest entry
+        count   int    // number of entries
+        lastSeq uint64 // sequence of the newest entry, first entry is 1
+    }
+)
+
+func NewReplayBuffer(capacity int) *ReplayBuffer {
+    if capacity < 1 {
+        capacity = 1
+    }
+
+    b := &ReplayBuffer{
+        entries: make([][]byte, capacity),
+    }
+    return b
+}
+
+// append message, overwrite the oldest one if buffer is full, returns sequence of message
+func (b *ReplayBuffer) Push(data []byte) uint64 {
+    capacity := len(b.entries)
+    if b.count < capacity {
+        b.entries[(b.head+b.count)%capacity] = data
+        b.count++
+    } else {
+        b.entries[b.head] = data
+        b.head = (b.head + 1) % capacity
+    }
+
+    b.lastSeq++
+    return b.lastSeq
+}
+
+func (b *ReplayBuffer) LastSeq() uint64 {
+    return b.lastSeq
+}
+
+// get all messages after seq, returns error if some of them already overwritten
+func (b *ReplayBuffer) Since(seq uint64) ([][]byte, error) {
+    if seq > b.lastSeq {
+        return nil, fmt.Errorf("sequence %d is newer than last sequence %d", seq, b.lastSeq)
+    }
+
+    missed := int(b.lastSeq - seq)
+    if missed > b.count {
+        return nil, fmt.Errorf("sequence %d is too old, %d messages missed, only %d kept", seq, missed, b.count)
+    }
+
+    capacity := len(b.entries)
+    list := make([][]byte, missed)
+    start := b.head + b.count - missed
+    for i := 0; i < missed; i++ {
+        list[i] = b.entries[(start+i)%capacity]
+    }
+    return list, nil
+}
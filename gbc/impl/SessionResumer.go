@@ -0,0 +1,190 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/dualface/go-cli-colorlog"
+    "github.com/dualface/go-gbc/gbc"
+)
+
+// resume protocol:
+//
+// 1. server sends ResumeTokenSubCmdId with session token after connection started
+// 2. server counts outbound messages from 1, client counts received messages in the same way
+// 3. after reconnect, client sends ResumeRequestSubCmdId with token and the last received sequence,
+//    and should not send other messages before got reply
+// 4. server replies ResumeAcceptedSubCmdId then replays missed messages on the new link,
+//    or replies ResumeRejectedSubCmdId, client should start a new session
+//
+// control messages are not counted in sequence,
+// data of control message is sequence (uint64, little endian) followed by token
+
+const (
+    ResumeMainCmdId        = 0xffff
+    ResumeTokenSubCmdId    = 1
+    ResumeRequestSubCmdId  = 2
+    ResumeAcceptedSubCmdId = 3
+    ResumeRejectedSubCmdId = 4
+
+    DefaultReplayCapacity    = 256
+    DefaultResumeGracePeriod = time.Second * 30
+
+    resumeSeqLen      = 8
+    resumeWaitTimeout = time.Second * 5
+)
+
+type (
+    SessionResumer struct {
+        // max number of outbound messages kept for replaying
+        ReplayCapacity int
+        // close the suspended connection if not resumed in time
+        GracePeriod time.Duration
+
+        connections map[string]*BasicConnection // token of current session -> connection
+        tokens      map[uint64]string            // id of connection -> token indexed
+        mutex       *sync.Mutex
+    }
+)
+
+func NewSessionResumer(replayCapacity int, gracePeriod time.Duration) *SessionResumer {
+    if replayCapacity < 1 {
+        replayCapacity = DefaultReplayCapacity
+    }
+    if gracePeriod <= 0 {
+        gracePeriod = DefaultResumeGracePeriod
+    }
+
+    r := &SessionResumer{
+        ReplayCapacity: replayCapacity,
+        GracePeriod:    gracePeriod,
+        connections:    make(map[string]*BasicConnection),
+        tokens:         make(map[uint64]string),
+        mutex:          &sync.Mutex{},
+    }
+    return r
+}
+
+// enable resuming on connection, must be called before connection started
+func (r *SessionResumer) Manage(c *BasicConnection) {
+    c.replay = NewReplayBuffer(r.ReplayCapacity)
+    c.resumeGrace = r.GracePeriod
+    c.controlFunc = r.handleControlMessage
+    c.sessionFunc = r.index
+    r.index(c, c.Session())
+
+    go func() {
+        <-c.Done()
+        r.mutex.Lock()
+        defer r.mutex.Unlock()
+        delete(r.connections, r.tokens[c.Id()])
+        delete(r.tokens, c.Id())
+    }()
+}
+
+// private
+
+// index connection by token of session, called again after session replaced by SetSession()
+func (r *SessionResumer) index(c *BasicConnection, s gbc.Session) {
+    var token string
+    if s != nil {
+        token = s.Token()
+    }
+
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    if c.isClosing() {
+        // removed from index after closed
+        return
+    }
+    delete(r.connections, r.tokens[c.Id()])
+    delete(r.tokens, c.Id())
+    if token != "" {
+        r.connections[token] = c
+        r.tokens[c.Id()] = token
+    }
+}
+
+func (r *SessionResumer) find(token string) *BasicConnection {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return r.connections[token]
+}
+
+func (r *SessionResumer) handleControlMessage(c *BasicConnection, m gbc.RawMessage) bool {
+    msg, ok := m.(*CommandMessage)
+    if !ok || msg.MainCmdId() != ResumeMainCmdId {
+        return false
+    }
+    if msg.SubCmdId() != ResumeRequestSubCmdId {
+        // ignore other control messages
+        return true
+    }
+
+    lastSeq, token, err := parseResumeControlData(msg.DataBytes())
+    target := r.find(token)
+    if err != nil || target == nil || target == c || !target.canResume(lastSeq) {
+        c.writeControl(newResumeControlMessage(ResumeRejectedSubCmdId, lastSeq, token))
+        return true
+    }
+
+    // forwarder must keep running until link of c detached
+    go r.resume(target, c, lastSeq)
+    return true
+}
+
+func (r *SessionResumer) resume(target *BasicConnection, c *BasicConnection, lastSeq uint64) {
+    rawConn, i, o, err := c.detach()
+    if err != nil {
+        return
+    }
+
+    err = target.resume(rawConn, i, o, lastSeq)
+    if err != nil {
+        // client will start a new session after reconnect
+        clog.PrintWarn("resume connection %d failed, %s", target.Id(), err)
+        rawConn.Close()
+    }
+}
+
+func newResumeControlMessage(subCmdId uint16, seq uint64, token string) []byte {
+    var buf bytes.Buffer
+    binary.Write(&buf, binary.LittleEndian, seq)
+    buf.WriteString(token)
+
+    m := NewCommandMessageFromData(ResumeMainCmdId, subCmdId, CommandMessageClangType, buf.Bytes())
+    return m.GenBytes()
+}
+
+func parseResumeControlData(data []byte) (uint64, string, error) {
+    if len(data) < resumeSeqLen {
+        return 0, "", fmt.Errorf("invalid resume control data")
+    }
+    return binary.LittleEndian.Uint64(data[:resumeSeqLen]), string(data[resumeSeqLen:]), nil
+}
@@ -0,0 +1,65 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package impl
+
+import (
+    "testing"
+    "time"
+)
+
+func TestSessionResumerIndex(t *testing.T) {
+    r := NewSessionResumer(0, 0)
+    c, remote, _ := newTestConnection()
+    defer remote.Close()
+    r.Manage(c)
+
+    old := c.Session().Token()
+    if r.find(old) != c {
+        t.Fatal("connection not indexed by token")
+    }
+
+    s := NewBasicSession()
+    c.SetSession(s)
+    if r.find(old) != nil {
+        t.Fatal("old token still indexed")
+    }
+    if r.find(s.Token()) != c {
+        t.Fatal("connection not indexed by new token")
+    }
+
+    c.Close()
+    waitConnectionDone(t, c)
+    for i := 0; i < 100 && r.find(s.Token()) != nil; i++ {
+        time.Sleep(time.Millisecond)
+    }
+    if r.find(s.Token()) != nil {
+        t.Fatal("closed connection still indexed")
+    }
+    c.SetSession(NewBasicSession())
+    r.mutex.Lock()
+    n := len(r.connections) + len(r.tokens)
+    r.mutex.Unlock()
+    if n != 0 {
+        t.Fatalf("%d entries left in index", n)
+    }
+}
@@ -0,0 +1,106 @@
+package lualib
+
+import (
+    "github.com/yuin/gopher-lua"
+)
+
+// actor module for Lua workers of ConcurrenceLuaHandler
+func luaActorLoader(h *ConcurrenceLuaHandler) lua.LGFunction {
+    return func(L *lua.LState) int {
+        actor := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+            "register": actorRegister,
+            "spawn": func(L *lua.LState) int {
+                return actorSpawn(L, h)
+            },
+            "send": func(L *lua.LState) int {
+                return actorSend(L, h)
+            },
+            "stop": func(L *lua.LState) int {
+                return actorStop(L, h)
+            },
+            "exists": func(L *lua.LState) int {
+                L.Push(lua.LBool(h.ActorExists(L.CheckString(1))))
+                return 1
+            },
+            "self": actorSelf,
+        })
+
+        L.Push(actor)
+        return 1
+    }
+}
+
+// private
+
+// actor.register(kind, factory), factory is class with New(id, args) or function(id, args) returns actor,
+// actor handles events by methods OnMessage(msg, from), OnStop(), Snapshot() and Restore(snapshot).
+// all Lua states must register same kinds before main loop starts
+func actorRegister(L *lua.LState) int {
+    kind := L.CheckString(1)
+    factory := L.Get(2)
+    switch factory.(type) {
+    case *lua.LTable, *lua.LFunction:
+    default:
+        L.ArgError(2, "class or function expected")
+    }
+
+    s := luaSchedulerOf(L)
+    if s == nil {
+        L.RaiseError("actor.register() must be called in Lua worker")
+    }
+    s.factories[kind] = factory
+    return 0
+}
+
+// actor.spawn(kind, id [, args]) returns true, or nil and error, args is copied to Lua state of actor
+func actorSpawn(L *lua.LState, h *ConcurrenceLuaHandler) int {
+    kind := L.CheckString(1)
+    id := L.CheckString(2)
+    args, err := LuaValueToGo(L.Get(3))
+    if err != nil {
+        L.ArgError(3, err.Error())
+    }
+    return pushLuaResult(L, h.SpawnActor(kind, id, args))
+}
+
+// actor.send(id, msg) returns true, or nil and error, msg is copied to Lua state of actor
+func actorSend(L *lua.LState, h *ConcurrenceLuaHandler) int {
+    id := L.CheckString(1)
+    msg, err := LuaValueToGo(L.Get(2))
+    if err != nil {
+        L.ArgError(2, err.Error())
+    }
+    return pushLuaResult(L, h.postToActor(id, msg, currentSender(L), nil))
+}
+
+// actor.stop([id]) returns true, or nil and error, stop calling actor if id is not set
+func actorStop(L *lua.LState, h *ConcurrenceLuaHandler) int {
+    id := L.OptString(1, currentActorId(L))
+    if id == "" {
+        L.ArgError(1, "actor id expected")
+    }
+    return pushLuaResult(L, h.StopActor(id))
+}
+
+// actor.self() returns id of actor which calling coroutine handles event for, or nil
+func actorSelf(L *lua.LState) int {
+    id := currentActorId(L)
+    if id == "" {
+        L.Push(lua.LNil)
+    } else {
+        L.Push(lua.LString(id))
+    }
+    return 1
+}
+
+func currentActorId(L *lua.LState) string {
+    s := luaSchedulerOf(L)
+    if s == nil {
+        return ""
+    }
+    t, ok := s.tasks[L]
+    if !ok || t.actor == nil {
+        return ""
+    }
+    return t.actor.ref.id
+}
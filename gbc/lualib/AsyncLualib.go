@@ -0,0 +1,97 @@
+package lualib
+
+import (
+    "context"
+    "time"
+
+    "github.com/yuin/gopher-lua"
+)
+
+// async module for message handlers running in ConcurrenceLuaHandler
+func luaAsyncLoader(h *ConcurrenceLuaHandler) lua.LGFunction {
+    return func(L *lua.LState) int {
+        async := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+            "call": func(L *lua.LState) int {
+                return asyncCall(L, h)
+            },
+            "sleep":   asyncSleep,
+            "spawn":   asyncSpawn,
+            "pending": asyncPending,
+        })
+
+        L.Push(async)
+        return 1
+    }
+}
+
+// private
+
+// async.call(name, ...) calls function registered by RegisterAsyncFunc, returns result, or nil and error
+func asyncCall(L *lua.LState, h *ConcurrenceLuaHandler) int {
+    name := L.CheckString(1)
+
+    h.mutex.RLock()
+    f, ok := h.asyncFuncs[name]
+    h.mutex.RUnlock()
+    if !ok {
+        L.RaiseError("async.call() function '%s' not found", name)
+    }
+
+    args := make([]interface{}, 0, L.GetTop()-1)
+    for i := 2; i <= L.GetTop(); i++ {
+        v, err := LuaValueToGo(L.Get(i))
+        if err != nil {
+            L.ArgError(i, err.Error())
+        }
+        args = append(args, v)
+    }
+
+    return Await(L, func(ctx context.Context) (interface{}, error) {
+        return f(ctx, args)
+    })
+}
+
+// async.sleep(seconds) suspends calling coroutine, returns true, or nil and error if timeout
+func asyncSleep(L *lua.LState) int {
+    d := luaSeconds(L.CheckNumber(1))
+
+    return Await(L, func(ctx context.Context) (interface{}, error) {
+        timer := time.NewTimer(d)
+        defer timer.Stop()
+
+        select {
+        case <-timer.C:
+            return true, nil
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        }
+    })
+}
+
+// async.spawn(fn, ...) runs fn(...) in new coroutine of the worker after current coroutine yields
+func asyncSpawn(L *lua.LState) int {
+    fn := L.CheckFunction(1)
+    s := luaSchedulerOf(L)
+    if s == nil {
+        L.RaiseError("async.spawn() must be called in Lua worker")
+    }
+
+    args := make([]lua.LValue, 0, L.GetTop()-1)
+    for i := 2; i <= L.GetTop(); i++ {
+        args = append(args, L.Get(i))
+    }
+
+    t := s.start(L, fn, args)
+    go s.deliver(&luaAsyncResult{task: t})
+    return 0
+}
+
+// async.pending() returns number of suspended coroutines in the worker
+func asyncPending(L *lua.LState) int {
+    s := luaSchedulerOf(L)
+    if s == nil {
+        L.Push(lua.LNumber(0))
+        return 1
+    }
+    return s.pending(L)
+}
@@ -2,26 +2,94 @@ package lualib
 
 import (
     "fmt"
+    "os"
+    "os/signal"
     "path/filepath"
     "reflect"
     "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
 
     "github.com/dualface/go-cli-colorlog"
     "github.com/dualface/go-gbc/gbc"
     "github.com/dualface/go-gbc/gbc/impl"
     "github.com/dualface/go-gbc/gbc/protoconv"
+    "github.com/golang/protobuf/proto"
     "github.com/yuin/gopher-lua"
     "layeh.com/gopher-luar"
 )
 
+const (
+    DefaultLuaBootTimeout  = 10 * time.Second
+    DefaultLuaRestartDelay = time.Second
+)
+
 type (
-    ConcurrenceLuaHandler struct {
+    // Lua states loaded from same version of scripts
+    luaPool struct {
+        version            int
         availLuaStates     chan lua.LValue
         luaStates          map[string]*lua.LState
+        schedulers         map[string]*luaScheduler
         messageToLuaChan   map[string]chan lua.LValue
         messageFromLuaChan map[string]chan lua.LValue
-        luaDir             string
-        luaFile            string
+        exited             chan string    // id of worker which main loop returned
+        dispatching        *sync.WaitGroup // messages got worker but not sent to it
+        supervised         int32           // restart dead workers
+        stopping           int32
+        shared             *atomic.Value // *luaSharedData read by Lua states
+        mutex              *sync.Mutex
+    }
+
+    ConcurrenceLuaHandler struct {
+        // waiting for new Lua states ready when reloading, zero means DefaultLuaBootTimeout
+        BootTimeout time.Duration
+        // waiting before restarting dead worker, zero means DefaultLuaRestartDelay
+        RestartDelay time.Duration
+        // abort Lua handler if handling one message takes longer than this, include time waiting for async IO,
+        // zero means no limit
+        MessageTimeout time.Duration
+        // abort Lua handler if handling one message executes more instructions than this, zero means no limit
+        InstructionBudget int64
+        // max depth of Lua call stack of each Lua state, zero means lua.CallStackSize,
+        // stack limits only, gopher-lua allocates Lua values on Go heap without hooks, so there is no memory budget
+        CallStackSize int
+        // max size of Lua data stack of each Lua state, zero means lua.RegistrySize, stack limit only like CallStackSize
+        RegistrySize int
+        // max number of messages suspended by async IO in each worker, zero means DefaultLuaMaxSuspended
+        MaxSuspended int
+        // called when Lua handler failed to handle message, error is always logged
+        OnError OnLuaHandlerErrorFunc
+        // if set, inbound message is sent to actor with the returned id if actor exists
+        ActorKey impl.MessageKeyFunc
+        // called when actor stopped or moved to new Lua state after reloading
+        OnActorSnapshot OnLuaActorSnapshotFunc
+        // if set, actor spawned or restarted with saved snapshot
+        LoadActorSnapshot LoadLuaActorSnapshotFunc
+        // if set, called when starting and reloading, returned data replaces shared data of Lua states
+        LoadSharedData LoadLuaSharedDataFunc
+
+        concurrence       int
+        pool              *luaPool
+        lastVersion       int
+        lastSharedVersion int
+        registrations     []func(L *lua.LState) // replay to new Lua states
+        asyncFuncs        map[string]LuaAsyncFunc
+        actors            map[string]*luaActorRef
+        restarts          map[string]int
+        luaDir            string
+        luaFile           string
+        locator           gbc.ConnectionLocator
+        started           bool
+        mutex             *sync.RWMutex
+        reloadMutex       *sync.Mutex
+    }
+
+    // message encoded by Lua worker, written to connection by output goroutine
+    luaOutputMessage struct {
+        connId uint64
+        bytes  []byte
     }
 )
 
@@ -31,89 +99,506 @@ func NewConcurrenceLuaHandler(concurrence int, luaDir string, luaFile string) *C
     }
 
     h := &ConcurrenceLuaHandler{
-        availLuaStates:     make(chan lua.LValue, concurrence),
-        luaStates:          make(map[string]*lua.LState, concurrence),
-        messageToLuaChan:   make(map[string]chan lua.LValue, concurrence),
-        messageFromLuaChan: make(map[string]chan lua.LValue, concurrence),
-        luaDir:             luaDir,
-        luaFile:            luaFile,
+        concurrence: concurrence,
+        luaDir:      luaDir,
+        luaFile:     luaFile,
+        restarts:    make(map[string]int, concurrence),
+        asyncFuncs:  make(map[string]LuaAsyncFunc),
+        actors:      make(map[string]*luaActorRef),
+        mutex:       &sync.RWMutex{},
+        reloadMutex: &sync.Mutex{},
     }
     if !filepath.IsAbs(h.luaFile) {
         h.luaFile = filepath.Clean(filepath.Join(h.luaDir, h.luaFile))
     }
 
-    for i := 0; i < concurrence; i++ {
-        id := strconv.Itoa(i + 1)
-        h.messageToLuaChan[id] = make(chan lua.LValue)
-        h.messageFromLuaChan[id] = make(chan lua.LValue)
-        h.luaStates[id] = h.createLuaState(id)
-    }
-
+    h.lastVersion = 1
+    h.pool = h.newPool(h.lastVersion)
     return h
 }
 
 func (h *ConcurrenceLuaHandler) RegisterModuleLoader(loader func(*lua.LState)) {
-    for _, L := range h.luaStates {
-        loader(L)
-    }
+    h.register(loader)
 }
 
 func (h *ConcurrenceLuaHandler) RegisterType(name string, vt interface{}) {
-    for _, L := range h.luaStates {
+    h.register(func(L *lua.LState) {
         L.SetGlobal(name, luar.NewType(L, vt))
-    }
+    })
 }
 
 func (h *ConcurrenceLuaHandler) RegisterGlobalVar(name string, v interface{}) {
-    for _, L := range h.luaStates {
+    h.register(func(L *lua.LState) {
         L.SetGlobal(name, luar.New(L, v))
-    }
+    })
 }
 
 func (h *ConcurrenceLuaHandler) RegisterGlobalFunc(name string, f lua.LGFunction) {
-    for _, L := range h.luaStates {
+    h.register(func(L *lua.LState) {
         L.SetGlobal(name, L.NewFunction(f))
-    }
+    })
+}
+
+// Lua calls f by async.call(name, ...), calling coroutine is suspended until f returns
+func (h *ConcurrenceLuaHandler) RegisterAsyncFunc(name string, f LuaAsyncFunc) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    h.asyncFuncs[name] = f
+}
+
+// Lua workers find connections by id when sending messages, e.g. BasicConnectionManager
+func (h *ConcurrenceLuaHandler) SetConnectionLocator(l gbc.ConnectionLocator) {
+    h.locator = l
 }
 
 func (h *ConcurrenceLuaHandler) Start() {
-    for id, L := range h.luaStates {
-        L := L
-        go func() {
-            err := L.DoFile(h.luaFile)
-            if err != nil {
-                clog.PrintWarn("Lua state %L has failed, %L", id, err.Error())
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    if h.started {
+        return
+    }
+    h.started = true
+    data, err := h.loadSharedData()
+    if err != nil {
+        clog.PrintError("load shared data failed, %s", err)
+    } else if data != nil {
+        h.pool.shared.Store(h.newSharedData(data))
+    }
+    atomic.StoreInt32(&h.pool.supervised, 1)
+    h.startPool(h.pool)
+}
+
+// load scripts from luaDir into new Lua states, switch to them after all booted,
+// messages being handled by old Lua states are finished, keep old Lua states if new scripts failed
+func (h *ConcurrenceLuaHandler) Reload() error {
+    h.reloadMutex.Lock()
+    defer h.reloadMutex.Unlock()
+
+    h.mutex.RLock()
+    old := h.pool
+    started := h.started
+    h.mutex.RUnlock()
+
+    if !started {
+        return fmt.Errorf("Lua handler is not started")
+    }
+
+    // new Lua states boot with new shared data, old Lua states keep old data until stopped
+    data, err := h.loadSharedData()
+    if err != nil {
+        return fmt.Errorf("reload shared data failed, %s", err)
+    }
+
+    h.lastVersion++
+    p := h.newPool(h.lastVersion)
+    if data != nil {
+        h.mutex.Lock()
+        p.shared.Store(h.newSharedData(data))
+        h.mutex.Unlock()
+    }
+    h.startPool(p)
+    err = h.waitPoolReady(p)
+    if err != nil {
+        // rollback
+        h.abortPool(p)
+        return fmt.Errorf("reload Lua scripts version %d failed, %s", p.version, err)
+    }
+
+    atomic.StoreInt32(&p.supervised, 1)
+    h.mutex.Lock()
+    h.pool = p
+    h.migrateActors(old, p)
+    h.mutex.Unlock()
+
+    clog.PrintInfo("Lua scripts reloaded, version %d", p.version)
+    go h.stopPool(old)
+    return nil
+}
+
+// version of running scripts, increase after each successful reloading, unchanged if reloading failed,
+// version of failed reloading is not reused
+func (h *ConcurrenceLuaHandler) Version() int {
+    h.mutex.RLock()
+    defer h.mutex.RUnlock()
+    return h.pool.version
+}
+
+// restart count of each worker, workers are restarted after main loop of Lua state returned
+func (h *ConcurrenceLuaHandler) Restarts() map[string]int {
+    h.mutex.RLock()
+    defer h.mutex.RUnlock()
+
+    restarts := make(map[string]int, len(h.restarts))
+    for id, n := range h.restarts {
+        restarts[id] = n
+    }
+    return restarts
+}
+
+// reload when signal received, e.g. syscall.SIGHUP, returns function to stop watching
+func (h *ConcurrenceLuaHandler) ReloadOnSignal(sig ...os.Signal) func() {
+    ch := make(chan os.Signal, 1)
+    signal.Notify(ch, sig...)
+    quit := make(chan struct{})
+
+    go func() {
+        for {
+            select {
+            case s := <-ch:
+                clog.PrintInfo("signal %s captured, reload Lua scripts", s)
+                h.reloadAndLog()
+
+            case <-quit:
+                signal.Stop(ch)
+                return
+            }
+        }
+    }()
+
+    return func() {
+        close(quit)
+    }
+}
+
+// reload when Lua files in luaDir changed, check every interval, returns function to stop watching
+func (h *ConcurrenceLuaHandler) ReloadOnChange(interval time.Duration) func() {
+    quit := make(chan struct{})
+
+    go func() {
+        last := h.scriptsStamp()
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-ticker.C:
+                stamp := h.scriptsStamp()
+                if stamp == last {
+                    continue
+                }
+                last = stamp
+                clog.PrintInfo("Lua scripts changed, reload")
+                h.reloadAndLog()
+
+            case <-quit:
+                return
             }
-        }()
+        }
+    }()
+
+    return func() {
+        close(quit)
     }
 }
 
 // interface RawMessageReceiver
 
 func (h *ConcurrenceLuaHandler) ReceiveRawMessage(m gbc.RawMessage) error {
+    if h.routeToActor(m) {
+        return nil
+    }
+
+    h.mutex.RLock()
+    p := h.pool
+    p.dispatching.Add(1)
+    h.mutex.RUnlock()
+
     // avoid blocking caller
     go func() {
-        avail := <-h.availLuaStates
+        defer p.dispatching.Done()
+
+        avail := <-p.availLuaStates
         id := avail.String()
 
-        L, ok := h.luaStates[id]
-        if !ok {
+        if _, ok := p.state(id); !ok {
             clog.PrintError("get invalid Lua worker id: %s", id)
             return
         }
 
-        v, err := h.convertMessageToLuaValue(L, m)
+        if _, ok := m.(*impl.CommandMessage); !ok {
+            p.availLuaStates <- avail
+            clog.PrintWarn("%T only support CommandMessage", h)
+            return
+        }
+
+        // Lua values must be created by goroutine of Lua state, so WORKER.HANDLE converts message
+        p.messageToLuaChan[id] <- &lua.LUserData{Value: m}
+    }()
+    return nil
+}
+
+// private
+
+// Lua state is not goroutine-safe, so running Lua states are never touched,
+// registering after Start() only applies to Lua states created by reloading and restarting
+func (h *ConcurrenceLuaHandler) register(f func(L *lua.LState)) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    h.registrations = append(h.registrations, f)
+    if h.started {
+        clog.PrintWarn("%T registered after started, applied to Lua states after reloading", h)
+        return
+    }
+    for _, L := range h.pool.states() {
+        f(L)
+    }
+}
+
+func (h *ConcurrenceLuaHandler) newPool(version int) *luaPool {
+    h.mutex.RLock()
+    registrations := h.registrations
+    shared := &luaSharedData{root: &luaSharedTable{fields: map[string]interface{}{}}}
+    if h.pool != nil {
+        shared = h.pool.sharedData()
+    }
+    h.mutex.RUnlock()
+
+    p := &luaPool{
+        version:            version,
+        availLuaStates:     make(chan lua.LValue, h.concurrence),
+        luaStates:          make(map[string]*lua.LState, h.concurrence),
+        schedulers:         make(map[string]*luaScheduler, h.concurrence),
+        messageToLuaChan:   make(map[string]chan lua.LValue, h.concurrence),
+        messageFromLuaChan: make(map[string]chan lua.LValue, h.concurrence),
+        exited:             make(chan string, h.concurrence),
+        dispatching:        &sync.WaitGroup{},
+        shared:             &atomic.Value{},
+        mutex:              &sync.Mutex{},
+    }
+    p.shared.Store(shared)
+
+    for i := 0; i < h.concurrence; i++ {
+        id := strconv.Itoa(i + 1)
+        p.messageToLuaChan[id] = make(chan lua.LValue)
+        p.messageFromLuaChan[id] = make(chan lua.LValue)
+        p.luaStates[id] = h.createLuaState(p, id, registrations)
+    }
+    return p
+}
+
+func (h *ConcurrenceLuaHandler) startPool(p *luaPool) {
+    for id, L := range p.states() {
+        go h.output(p.messageFromLuaChan[id])
+        go h.run(p, id, L)
+    }
+}
+
+// run main loop of Lua state, recreate Lua state with same id if main loop returned unexpectedly
+func (h *ConcurrenceLuaHandler) run(p *luaPool, id string, L *lua.LState) {
+    for {
+        err := L.DoFile(h.luaFile)
+        luaSchedulerOf(L).close()
+        L.Close()
+        if atomic.LoadInt32(&p.stopping) != 0 {
+            break
+        }
         if err != nil {
-            h.availLuaStates <- avail
-            clog.PrintWarn(err.Error())
+            clog.PrintWarn("Lua state %s has failed, %s", id, err.Error())
         } else {
-            h.messageToLuaChan[id] <- v
+            clog.PrintWarn("Lua state %s main loop exited", id)
+        }
+        if atomic.LoadInt32(&p.supervised) == 0 {
+            // booting, let reloading fail
+            break
+        }
+
+        delay := h.RestartDelay
+        if delay <= 0 {
+            delay = DefaultLuaRestartDelay
+        }
+        time.Sleep(delay)
+        if atomic.LoadInt32(&p.stopping) != 0 {
+            break
+        }
+
+        h.mutex.Lock()
+        registrations := h.registrations
+        h.restarts[id]++
+        n := h.restarts[id]
+        h.mutex.Unlock()
+
+        L = h.createLuaState(p, id, registrations)
+        p.setState(id, L)
+        h.respawnActors(p, id)
+        clog.PrintInfo("Lua state %s restarted, %d times", id, n)
+    }
+
+    // Lua state will not send message any more
+    close(p.messageFromLuaChan[id])
+    p.exited <- id
+}
+
+// all workers are idle after booting
+func (h *ConcurrenceLuaHandler) waitPoolReady(p *luaPool) error {
+    timeout := h.BootTimeout
+    if timeout <= 0 {
+        timeout = DefaultLuaBootTimeout
+    }
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+
+    ready := make([]lua.LValue, 0, h.concurrence)
+    defer func() {
+        for _, id := range ready {
+            p.availLuaStates <- id
         }
     }()
+
+    for len(ready) < h.concurrence {
+        select {
+        case id := <-p.availLuaStates:
+            ready = append(ready, id)
+
+        case id := <-p.exited:
+            p.exited <- id
+            return fmt.Errorf("Lua state %s exited when booting", id)
+
+        case <-timer.C:
+            return fmt.Errorf("Lua states not ready in %s", timeout)
+        }
+    }
     return nil
 }
 
-// private
+// waiting for all workers idle, then exit main loop of Lua states
+func (h *ConcurrenceLuaHandler) stopPool(p *luaPool) {
+    atomic.StoreInt32(&p.stopping, 1)
+    p.dispatching.Wait()
+
+    stopped := make(map[string]bool, h.concurrence)
+    for len(stopped) < h.concurrence {
+        var id string
+        select {
+        case avail := <-p.availLuaStates:
+            id = avail.String()
+        case id = <-p.exited:
+        }
+        if stopped[id] {
+            continue
+        }
+        stopped[id] = true
+        close(p.messageToLuaChan[id])
+    }
+    clog.PrintInfo("Lua scripts version %d stopped", p.version)
+}
+
+// pool is never used, so no message is dispatched to it, exit main loop of Lua states without waiting,
+// Lua states not booted yet exit after reading closed INPUT_CHAN
+func (h *ConcurrenceLuaHandler) abortPool(p *luaPool) {
+    atomic.StoreInt32(&p.stopping, 1)
+    for _, ch := range p.messageToLuaChan {
+        close(ch)
+    }
+    clog.PrintInfo("Lua scripts version %d aborted", p.version)
+}
+
+// time of last modified Lua file and number of Lua files in luaDir
+func (h *ConcurrenceLuaHandler) scriptsStamp() string {
+    var last time.Time
+    count := 0
+    filepath.Walk(h.luaDir, func(path string, info os.FileInfo, err error) error {
+        if err != nil || info.IsDir() || filepath.Ext(path) != ".lua" {
+            return nil
+        }
+        count++
+        if info.ModTime().After(last) {
+            last = info.ModTime()
+        }
+        return nil
+    })
+    return fmt.Sprintf("%d:%d", last.UnixNano(), count)
+}
+
+func (h *ConcurrenceLuaHandler) reloadAndLog() {
+    err := h.Reload()
+    if err != nil {
+        clog.PrintError(err.Error())
+    }
+}
+
+func (h *ConcurrenceLuaHandler) createLuaState(p *luaPool, id string, registrations []func(L *lua.LState)) *lua.LState {
+    L := lua.NewState(lua.Options{
+        CallStackSize: h.CallStackSize,
+        RegistrySize:  h.RegistrySize,
+    })
+    worker := L.NewTable()
+    worker.RawSetString("ID", lua.LString(id))
+    worker.RawSetString("VERSION", lua.LNumber(p.version))
+    worker.RawSetString("BOOT_DIR", lua.LString(h.luaDir))
+    worker.RawSetString("INPUT_CHAN", lua.LChannel(p.messageToLuaChan[id]))
+    worker.RawSetString("OUTPUT_CHAN", lua.LChannel(p.messageFromLuaChan[id]))
+    worker.RawSetString("WORKER_CHAN", lua.LChannel(p.availLuaStates))
+
+    // message handlers run in coroutines, suspended by async IO and resumed by events from RESUME_CHAN
+    s := newLuaScheduler(h, L, id)
+    p.setScheduler(id, s)
+    worker.RawSetString("HANDLE", L.NewFunction(s.handle))
+    worker.RawSetString("RESUME", L.NewFunction(s.resume))
+    worker.RawSetString("PENDING", L.NewFunction(s.pending))
+    worker.RawSetString("RESUME_CHAN", lua.LChannel(s.resumeChan))
+    worker.RawSetString("SEND", L.NewFunction(luaOutputSender(p.messageFromLuaChan[id])))
+    L.PreloadModule("async", luaAsyncLoader(h))
+    L.PreloadModule("timer", luaTimerLoader)
+    L.PreloadModule("actor", luaActorLoader(h))
+    L.PreloadModule("worker", luaWorkerLoader(h))
+    L.PreloadModule("shared", luaSharedLoader(p))
+    L.SetGlobal("WORKER", worker)
+
+    for _, f := range registrations {
+        f(L)
+    }
+    return L
+}
+
+func (p *luaPool) state(id string) (*lua.LState, bool) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    L, ok := p.luaStates[id]
+    return L, ok
+}
+
+func (p *luaPool) setState(id string, L *lua.LState) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    p.luaStates[id] = L
+}
+
+func (p *luaPool) scheduler(id string) *luaScheduler {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    return p.schedulers[id]
+}
+
+func (p *luaPool) setScheduler(id string, s *luaScheduler) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    p.schedulers[id] = s
+}
+
+func (p *luaPool) states() map[string]*lua.LState {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    states := make(map[string]*lua.LState, len(p.luaStates))
+    for id, L := range p.luaStates {
+        states[id] = L
+    }
+    return states
+}
+
+func (h *ConcurrenceLuaHandler) reportError(err *LuaHandlerError) {
+    if err.Traceback != "" {
+        clog.PrintError("%s\n%s", err, err.Traceback)
+    } else {
+        clog.PrintError(err.Error())
+    }
+    if h.OnError != nil {
+        h.OnError(err)
+    }
+}
 
 func (h *ConcurrenceLuaHandler) convertMessageToLuaValue(L *lua.LState, m gbc.RawMessage) (lua.LValue, error) {
     msg, ok := m.(*impl.CommandMessage)
@@ -132,23 +617,125 @@ func (h *ConcurrenceLuaHandler) convertMessageToLuaValue(L *lua.LState, m gbc.Ra
         tb := L.NewTable()
         tb.RawSetString("type", lua.LString(typeName))
         tb.RawSetString("msg", lv)
+        tb.RawSetString("mainCmdId", lua.LNumber(msg.MainCmdId()))
+        tb.RawSetString("subCmdId", lua.LNumber(msg.SubCmdId()))
+        if msg.HasRequestId() {
+            tb.RawSetString("requestId", lua.LNumber(msg.RequestId()))
+        }
+
+        // Lua worker can read and write session of the connection which message comes from
+        c := msg.Connection()
+        if c != nil {
+            tb.RawSetString("connId", lua.LNumber(c.Id()))
+            tb.RawSetString("session", luar.New(L, c.Session()))
+        }
         return tb, nil
 
     default:
         return nil, fmt.Errorf("%T not support DataType %d", h, msg.DataType())
     }
+}
 
-    return lua.LNil, nil
+// write messages sent by Lua worker to connections
+func (h *ConcurrenceLuaHandler) output(from chan lua.LValue) {
+    for v := range from {
+        err := h.sendLuaMessage(v)
+        if err != nil {
+            clog.PrintWarn("sending message from Lua failed, %s", err)
+        }
+    }
 }
 
-func (h *ConcurrenceLuaHandler) createLuaState(id string) *lua.LState {
-    L := lua.NewState()
-    worker := L.NewTable()
-    worker.RawSetString("ID", lua.LString(id))
-    worker.RawSetString("BOOT_DIR", lua.LString(h.luaDir))
-    worker.RawSetString("INPUT_CHAN", lua.LChannel(h.messageToLuaChan[id]))
-    worker.RawSetString("OUTPUT_CHAN", lua.LChannel(h.messageFromLuaChan[id]))
-    worker.RawSetString("WORKER_CHAN", lua.LChannel(h.availLuaStates))
-    L.SetGlobal("WORKER", worker)
-    return L
+// Lua values can't be read out of goroutine of Lua state, so messages are encoded by WORKER.SEND before sending
+func (h *ConcurrenceLuaHandler) sendLuaMessage(v lua.LValue) error {
+    ud, ok := v.(*lua.LUserData)
+    if !ok {
+        return fmt.Errorf("expected message sent by WORKER.SEND, got %s", v.Type())
+    }
+    out, ok := ud.Value.(*luaOutputMessage)
+    if !ok {
+        return fmt.Errorf("expected message sent by WORKER.SEND, got %T", ud.Value)
+    }
+
+    if h.locator == nil {
+        return fmt.Errorf("not set connection locator")
+    }
+    c, err := h.locator.Connection(out.connId)
+    if err != nil {
+        return fmt.Errorf("connection %d: %s", out.connId, err)
+    }
+
+    if w, ok := c.(gbc.AsyncWriter); ok {
+        return w.Enqueue(out.bytes)
+    }
+    _, err = c.Write(out.bytes)
+    return err
+}
+
+// WORKER.SEND(connId, cmd, msg, requestId) encodes message and sends it to OUTPUT_CHAN, returns true, or nil and error,
+// cmd is { mainCmdId, subCmdId } or { mainCmdId = 1, subCmdId = 2 }, requestId is nil if message is not a reply
+func luaOutputSender(out chan lua.LValue) lua.LGFunction {
+    return func(L *lua.LState) int {
+        connId := L.CheckNumber(1)
+        b, err := encodeLuaMessage(L, 2, 3, L.Get(4))
+        if err != nil {
+            return pushLuaResult(L, err)
+        }
+
+        // Lua can't send userdata to channel
+        out <- &lua.LUserData{Value: &luaOutputMessage{connId: uint64(connId), bytes: b}}
+        return pushLuaResult(L, nil)
+    }
+}
+
+// msg is proto message or table of fields, command ids can be nil if msg is proto message registered to protoconv,
+// requestId is nil if message is not a reply
+func newCommandMessageFromLua(main lua.LValue, sub lua.LValue, msg lua.LValue, requestId lua.LValue) (*impl.CommandMessage, error) {
+    mainCmdId, hasMain := main.(lua.LNumber)
+    subCmdId, hasSub := sub.(lua.LNumber)
+    hasCmd := hasMain && hasSub
+
+    var pb proto.Message
+    switch m := msg.(type) {
+    case *lua.LUserData:
+        var ok bool
+        pb, ok = m.Value.(proto.Message)
+        if !ok {
+            return nil, fmt.Errorf("expected proto message, got %T", m.Value)
+        }
+        if !hasCmd {
+            registeredMain, registeredSub, ok := protoconv.LookupProtoToCommandMessage(pb)
+            if !ok {
+                return nil, fmt.Errorf("not found registered command for %T", pb)
+            }
+            mainCmdId, subCmdId = lua.LNumber(registeredMain), lua.LNumber(registeredSub)
+        }
+
+    case *lua.LTable:
+        if !hasCmd {
+            return nil, fmt.Errorf("not set command id for table message")
+        }
+        c, ok := protoconv.LookupCommandMessageToProto(int(mainCmdId), int(subCmdId))
+        if !ok {
+            return nil, fmt.Errorf("not found registered command %d:%d", int(mainCmdId), int(subCmdId))
+        }
+        pb = c()
+        err := LuaTableToStruct(m, pb)
+        if err != nil {
+            return nil, fmt.Errorf("command %d:%d %s", int(mainCmdId), int(subCmdId), err)
+        }
+
+    default:
+        return nil, fmt.Errorf("invalid msg, got %s", m.Type())
+    }
+
+    data, err := proto.Marshal(pb)
+    if err != nil {
+        return nil, err
+    }
+
+    if requestId, ok := requestId.(lua.LNumber); ok {
+        return impl.NewCommandMessageWithRequestId(uint16(mainCmdId), uint16(subCmdId), impl.CommandMessageProtobufType, uint32(requestId), data), nil
+    }
+    return impl.NewCommandMessageFromData(uint16(mainCmdId), uint16(subCmdId), impl.CommandMessageProtobufType, data), nil
 }
@@ -0,0 +1,225 @@
+package lualib
+
+import (
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc/impl"
+    "github.com/dualface/go-gbc/gbc/protoconv"
+    "github.com/golang/protobuf/proto"
+    "github.com/golang/protobuf/ptypes/wrappers"
+    "github.com/yuin/gopher-lua"
+)
+
+const testLuaHeader = `
+package.path = string.format("%s/?.lua;./?.lua", WORKER.BOOT_DIR)
+require("stdlib.ext")
+require("gbc.init")
+`
+
+const testLuaStartLoop = `
+gbc.MessageHandler.New(WORKER.ID, WORKER.WORKER_CHAN, WORKER.INPUT_CHAN, WORKER.OUTPUT_CHAN):StartLoop()
+`
+
+// create dir with main.lua and scripts of luasrc, remove it after test
+func newTestLuaDir(t *testing.T, main string) string {
+    t.Helper()
+    dir, err := ioutil.TempDir("", "lualib")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    src, _ := filepath.Abs("../luasrc")
+    for _, name := range []string{"gbc", "stdlib"} {
+        os.Symlink(filepath.Join(src, name), filepath.Join(dir, name))
+    }
+    writeTestLuaFile(t, dir, main)
+    return dir
+}
+
+func writeTestLuaFile(t *testing.T, dir string, main string) {
+    t.Helper()
+    err := ioutil.WriteFile(filepath.Join(dir, "main.lua"), []byte(testLuaHeader+main+testLuaStartLoop), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func registerTestStringValue(mainCmdId int, subCmdId int) {
+    protoconv.RegisterCommandMessageToProto(mainCmdId, subCmdId, func() proto.Message {
+        return &wrappers.StringValue{}
+    })
+}
+
+func marshalTestStringValue(v string) []byte {
+    b, _ := proto.Marshal(&wrappers.StringValue{Value: v})
+    return b
+}
+
+func TestConcurrenceLuaHandlerReply(t *testing.T) {
+    registerTestStringValue(41, 1)
+    registerTestStringValue(41, 2)
+    dir := newTestLuaDir(t, `
+function gbc.MessageHandler:ReceiveProtoMessage(msg)
+    if msg.subCmdId == 1 then
+        self:Reply(msg, { value = msg.msg.Value .. "!" })
+    else
+        local pb = StringValue()
+        pb.Value = msg.msg.Value .. "?"
+        self:SendMessage(msg.connId, nil, pb, msg.requestId)
+    end
+end
+`)
+    defer os.RemoveAll(dir)
+
+    h := NewConcurrenceLuaHandler(2, dir, "main.lua")
+    h.RegisterModuleLoader(LuaProtoLoader)
+    h.RegisterType("StringValue", wrappers.StringValue{})
+
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    cm := impl.NewBasicConnectionManager()
+    cm.DefaultGroup.OnRawMessage(h.ReceiveRawMessage)
+    h.SetConnectionLocator(cm)
+    h.Start()
+    go cm.Start(l)
+    defer cm.Stop()
+
+    cl, err := impl.DialCommandClient(l.Addr().String(), time.Second)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cl.Close()
+
+    for sub, want := range map[uint16]string{1: "a!", 2: "a?"} {
+        r, err := cl.Call(41, sub, impl.CommandMessageProtobufType, marshalTestStringValue("a"), time.Second)
+        if err != nil {
+            t.Fatal(sub, err)
+        }
+        pb := &wrappers.StringValue{}
+        proto.Unmarshal(r.DataBytes(), pb)
+        if pb.Value != want || r.MainCmdId() != 41 {
+            t.Fatalf("command 41:%d got reply %s %q", sub, r, pb.Value)
+        }
+    }
+}
+
+func TestConcurrenceLuaHandlerReload(t *testing.T) {
+    registerTestStringValue(43, 1)
+    script := func(value string) string {
+        return `
+function gbc.MessageHandler:ReceiveProtoMessage(msg)
+    RECORD(WORKER.VERSION, "` + value + `")
+end
+`
+    }
+    dir := newTestLuaDir(t, script("v1"))
+    defer os.RemoveAll(dir)
+
+    records := make(chan string, 10)
+    h := NewConcurrenceLuaHandler(2, dir, "main.lua")
+    h.BootTimeout = time.Second
+    h.RegisterModuleLoader(LuaProtoLoader)
+    h.RegisterGlobalFunc("RECORD", func(L *lua.LState) int {
+        records <- L.CheckString(2) + "@" + L.CheckAny(1).String()
+        return 0
+    })
+    h.Start()
+
+    send := func() string {
+        h.ReceiveRawMessage(impl.NewCommandMessageFromData(43, 1, impl.CommandMessageProtobufType, marshalTestStringValue("x")))
+        select {
+        case r := <-records:
+            return r
+        case <-time.After(time.Second):
+            return "timeout"
+        }
+    }
+    if r := send(); r != "v1@1" {
+        t.Fatalf("handled by %s", r)
+    }
+
+    writeTestLuaFile(t, dir, script("v2"))
+    if err := h.Reload(); err != nil {
+        t.Fatal(err)
+    }
+    if r := send(); r != "v2@2" || h.Version() != 2 {
+        t.Fatalf("handled by %s, version %d", r, h.Version())
+    }
+
+    // broken scripts roll back, old Lua states keep serving
+    ioutil.WriteFile(filepath.Join(dir, "main.lua"), []byte("error('broken')"), 0644)
+    if err := h.Reload(); err == nil {
+        t.Fatal("reloaded broken scripts")
+    }
+    for i := 0; i < 4; i++ {
+        if r := send(); r != "v2@2" || h.Version() != 2 {
+            t.Fatalf("handled by %s, version %d", r, h.Version())
+        }
+    }
+
+    // version of failed reloading is skipped
+    writeTestLuaFile(t, dir, script("v4"))
+    if err := h.Reload(); err != nil {
+        t.Fatal(err)
+    }
+    if r := send(); r != "v4@4" || h.Version() != 4 {
+        t.Fatalf("handled by %s, version %d", r, h.Version())
+    }
+}
+
+func TestConcurrenceLuaHandlerRestart(t *testing.T) {
+    registerTestStringValue(44, 1)
+    dir := newTestLuaDir(t, `
+function gbc.MessageHandler:ReceiveProtoMessage(msg)
+    if msg.msg.Value == "crash" then
+        -- errors of handler are caught, crash main loop
+        gbc.MessageHandler.SetIdle = function() error("crash") end
+        return
+    end
+    RECORD(WORKER.ID, GREETING)
+end
+`)
+    defer os.RemoveAll(dir)
+
+    records := make(chan string, 10)
+    h := NewConcurrenceLuaHandler(1, dir, "main.lua")
+    h.RestartDelay = time.Millisecond * 10
+    h.RegisterModuleLoader(LuaProtoLoader)
+    h.RegisterGlobalVar("GREETING", "hello")
+    h.RegisterGlobalFunc("RECORD", func(L *lua.LState) int {
+        records <- L.CheckString(1) + ":" + L.CheckString(2)
+        return 0
+    })
+    h.Start()
+
+    send := func(v string) string {
+        h.ReceiveRawMessage(impl.NewCommandMessageFromData(44, 1, impl.CommandMessageProtobufType, marshalTestStringValue(v)))
+        select {
+        case r := <-records:
+            return r
+        case <-time.After(time.Millisecond * 500):
+            return "timeout"
+        }
+    }
+    if r := send("a"); r != "1:hello" {
+        t.Fatalf("handled by %s", r)
+    }
+    if r := send("crash"); r != "timeout" {
+        t.Fatalf("handled by %s", r)
+    }
+
+    // restarted worker has same id and registrations
+    if r := send("b"); r != "1:hello" {
+        t.Fatalf("handled by %s", r)
+    }
+    if n := h.Restarts()["1"]; n != 1 {
+        t.Fatalf("worker restarted %d times", n)
+    }
+}
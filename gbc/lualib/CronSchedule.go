@@ -0,0 +1,153 @@
+package lualib
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+type (
+    // five fields cron schedule: minute hour day month weekday,
+    // field supports *, */n, a, a-b, a-b/n and comma separated list, weekday 0 or 7 is Sunday
+    cronSchedule struct {
+        minute  uint64
+        hour    uint64
+        day     uint64
+        month   uint64
+        weekday uint64
+        anyDay  bool // day is *
+        anyWeek bool // weekday is *
+    }
+
+    cronField struct {
+        name string
+        min  int
+        max  int
+    }
+)
+
+var cronFields = []cronField{
+    {"minute", 0, 59},
+    {"hour", 0, 23},
+    {"day", 1, 31},
+    {"month", 1, 12},
+    {"weekday", 0, 7},
+}
+
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+    parts := strings.Fields(spec)
+    if len(parts) != len(cronFields) {
+        return nil, fmt.Errorf("invalid cron spec '%s', expected %d fields", spec, len(cronFields))
+    }
+
+    bits := make([]uint64, len(parts))
+    for i, part := range parts {
+        b, err := parseCronField(part, cronFields[i])
+        if err != nil {
+            return nil, fmt.Errorf("invalid cron spec '%s', %s", spec, err)
+        }
+        bits[i] = b
+    }
+
+    s := &cronSchedule{
+        minute:  bits[0],
+        hour:    bits[1],
+        day:     bits[2],
+        month:   bits[3],
+        weekday: bits[4],
+        anyDay:  parts[2] == "*",
+        anyWeek: parts[4] == "*",
+    }
+    if s.weekday&(1<<7) != 0 {
+        s.weekday |= 1
+    }
+    return s, nil
+}
+
+// next fire time after t, zero if not found in 5 years
+func (s *cronSchedule) Next(t time.Time) time.Time {
+    t = t.Truncate(time.Minute).Add(time.Minute)
+    limit := t.AddDate(5, 0, 0)
+
+    for t.Before(limit) {
+        if s.month&(1<<uint(t.Month())) == 0 {
+            t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+        if !s.matchDay(t) {
+            t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+        if s.hour&(1<<uint(t.Hour())) == 0 {
+            t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+            continue
+        }
+        if s.minute&(1<<uint(t.Minute())) == 0 {
+            t = t.Add(time.Minute)
+            continue
+        }
+        return t
+    }
+    return time.Time{}
+}
+
+// private
+
+// day and weekday are matched like crontab, either of them matches if both are restricted
+func (s *cronSchedule) matchDay(t time.Time) bool {
+    day := s.day&(1<<uint(t.Day())) != 0
+    week := s.weekday&(1<<uint(t.Weekday())) != 0
+    switch {
+    case s.anyDay && s.anyWeek:
+        return true
+    case s.anyDay:
+        return week
+    case s.anyWeek:
+        return day
+    default:
+        return day || week
+    }
+}
+
+func parseCronField(field string, f cronField) (uint64, error) {
+    var bits uint64
+    for _, item := range strings.Split(field, ",") {
+        step := 1
+        if i := strings.Index(item, "/"); i >= 0 {
+            n, err := strconv.Atoi(item[i+1:])
+            if err != nil || n < 1 {
+                return 0, fmt.Errorf("invalid step of %s: %s", f.name, item)
+            }
+            step = n
+            item = item[:i]
+        }
+
+        min, max := f.min, f.max
+        if item != "*" {
+            bounds := strings.SplitN(item, "-", 2)
+            n, err := strconv.Atoi(bounds[0])
+            if err != nil {
+                return 0, fmt.Errorf("invalid %s: %s", f.name, item)
+            }
+            min, max = n, n
+            if len(bounds) == 2 {
+                max, err = strconv.Atoi(bounds[1])
+                if err != nil {
+                    return 0, fmt.Errorf("invalid %s: %s", f.name, item)
+                }
+            } else if step > 1 {
+                // a/n means from a to max
+                max = f.max
+            }
+        }
+        if min < f.min || max > f.max || min > max {
+            return 0, fmt.Errorf("%s out of range: %s", f.name, item)
+        }
+
+        for i := min; i <= max; i += step {
+            bits |= 1 << uint(i)
+        }
+    }
+    return bits, nil
+}
@@ -0,0 +1,119 @@
+package lualib
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+    bits := func(list ...int) uint64 {
+        var b uint64
+        for _, i := range list {
+            b |= 1 << uint(i)
+        }
+        return b
+    }
+
+    cases := []struct {
+        field string
+        index int
+        want  uint64
+    }{
+        {"5", 0, bits(5)},
+        {"1,3,5", 1, bits(1, 3, 5)},
+        {"10-13", 0, bits(10, 11, 12, 13)},
+        {"*/15", 0, bits(0, 15, 30, 45)},
+        {"10-20/5", 0, bits(10, 15, 20)},
+        {"50/3", 0, bits(50, 53, 56, 59)},
+        {"*/10", 2, bits(1, 11, 21, 31)},
+        {"1-2,11", 3, bits(1, 2, 11)},
+    }
+    for _, c := range cases {
+        got, err := parseCronField(c.field, cronFields[c.index])
+        if err != nil {
+            t.Fatalf("parse %s of %s failed, %s", c.field, cronFields[c.index].name, err)
+        }
+        if got != c.want {
+            t.Fatalf("parse %s of %s got %b, want %b", c.field, cronFields[c.index].name, got, c.want)
+        }
+    }
+
+    for _, spec := range []string{
+        "* * * *",
+        "* * * * * *",
+        "60 * * * *",
+        "* 24 * * *",
+        "* * 0 * *",
+        "* * * 13 *",
+        "* * * * 8",
+        "*/0 * * * *",
+        "a * * * *",
+        "5-1 * * * *",
+        "1-a * * * *",
+    } {
+        if _, err := parseCronSchedule(spec); err == nil {
+            t.Fatalf("parsed invalid spec '%s'", spec)
+        }
+    }
+
+    // 7 is Sunday too
+    s, err := parseCronSchedule("0 0 * * 7")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if s.weekday != bits(0, 7) {
+        t.Fatalf("weekday %b", s.weekday)
+    }
+}
+
+func TestCronScheduleNext(t *testing.T) {
+    // 2026-10-19 is Monday
+    cases := []struct {
+        spec string
+        from string
+        want string
+    }{
+        {"* * * * *", "2026-10-19 10:07:30", "2026-10-19 10:08"},
+        {"*/15 * * * *", "2026-10-19 10:07", "2026-10-19 10:15"},
+        {"*/15 * * * *", "2026-10-19 10:15", "2026-10-19 10:30"},
+        {"0 3 * * *", "2026-10-19 10:07", "2026-10-20 03:00"},
+        {"30 8 1 * *", "2026-10-31 10:00", "2026-11-01 08:30"},
+        {"0 0 1 1 *", "2026-10-19 10:00", "2027-01-01 00:00"},
+        {"5-10/5 1,2 * 2 *", "2026-10-19 10:00", "2027-02-01 01:05"},
+        {"0 0 29 2 *", "2026-03-01 00:00", "2028-02-29 00:00"},
+        {"0 0 31 * *", "2026-11-01 00:00", "2026-12-31 00:00"},
+
+        // Sunday is 0 or 7
+        {"0 0 * * 0", "2026-10-19 10:00", "2026-10-25 00:00"},
+        {"0 0 * * 7", "2026-10-19 10:00", "2026-10-25 00:00"},
+        {"0 0 * * 1-5", "2026-10-24 10:00", "2026-10-26 00:00"},
+
+        // either day or weekday matches if both are restricted
+        {"0 0 13 * 5", "2026-10-19 10:00", "2026-10-23 00:00"},
+        {"0 0 20 * 5", "2026-10-19 10:00", "2026-10-20 00:00"},
+
+        // day is restricted only
+        {"0 0 13 * *", "2026-10-19 10:00", "2026-11-13 00:00"},
+    }
+    for _, c := range cases {
+        s, err := parseCronSchedule(c.spec)
+        if err != nil {
+            t.Fatal(err)
+        }
+        layout := "2006-01-02 15:04"
+        if len(c.from) > len(layout) {
+            layout += ":05"
+        }
+        from, _ := time.ParseInLocation(layout, c.from, time.Local)
+        got := s.Next(from).Format("2006-01-02 15:04")
+        if got != c.want {
+            t.Fatalf("'%s' after %s got %s, want %s", c.spec, c.from, got, c.want)
+        }
+    }
+
+    // never fires
+    s, _ := parseCronSchedule("0 0 31 2 *")
+    if next := s.Next(time.Now()); !next.IsZero() {
+        t.Fatalf("'0 0 31 2 *' fires at %s", next)
+    }
+}
@@ -0,0 +1,265 @@
+package lualib
+
+import (
+    "fmt"
+
+    "github.com/dualface/go-gbc/gbc"
+    "github.com/dualface/go-gbc/gbc/impl"
+    "github.com/yuin/gopher-lua"
+)
+
+type (
+    luaGroupLib struct {
+        cm *impl.BasicConnectionManager
+        f  gbc.OnRawMessageFunc
+    }
+)
+
+// group module works with groups of manager, messages of groups created by Lua are handled by f,
+// e.g. handler.RegisterModuleLoader(lualib.LuaGroupLoader(cm, handler.ReceiveRawMessage))
+func LuaGroupLoader(cm *impl.BasicConnectionManager, f gbc.OnRawMessageFunc) func(*lua.LState) {
+    lib := &luaGroupLib{cm: cm, f: f}
+
+    return func(L *lua.LState) {
+        L.PreloadModule("group", func(L *lua.LState) int {
+            group := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+                "New":       lib.create,
+                "Close":     lib.close,
+                "Names":     lib.names,
+                "Members":   lib.members,
+                "Len":       lib.len,
+                "Has":       lib.has,
+                "Of":        lib.of,
+                "Add":       lib.add,
+                "Remove":    lib.remove,
+                "Move":      lib.move,
+                "Broadcast": lib.broadcast,
+                "SendTo":    lib.sendTo,
+            })
+
+            L.Push(group)
+            return 1
+        })
+    }
+}
+
+// private
+
+// group.New(name) returns true, or nil and error
+func (lib *luaGroupLib) create(L *lua.LState) int {
+    _, err := lib.cm.NewGroup(L.CheckString(1), lib.f)
+    return pushLuaResult(L, err)
+}
+
+// group.Close(name) returns true, or nil and error
+func (lib *luaGroupLib) close(L *lua.LState) int {
+    return pushLuaResult(L, lib.cm.Groups.Close(L.CheckString(1)))
+}
+
+// group.Names() returns array of group names
+func (lib *luaGroupLib) names(L *lua.LState) int {
+    tb := L.NewTable()
+    for _, name := range lib.cm.Groups.Names() {
+        tb.Append(lua.LString(name))
+    }
+    L.Push(tb)
+    return 1
+}
+
+// group.Members(name) returns array of connection ids, or nil and error
+func (lib *luaGroupLib) members(L *lua.LState) int {
+    g, err := lib.group(L.CheckString(1))
+    if err != nil {
+        return pushLuaResult(L, err)
+    }
+
+    tb := L.NewTable()
+    g.Range(func(c gbc.Connection) bool {
+        tb.Append(lua.LNumber(c.Id()))
+        return true
+    })
+    L.Push(tb)
+    return 1
+}
+
+// group.Len(name) returns number of connections, or nil and error
+func (lib *luaGroupLib) len(L *lua.LState) int {
+    g, err := lib.group(L.CheckString(1))
+    if err != nil {
+        return pushLuaResult(L, err)
+    }
+
+    L.Push(lua.LNumber(g.Len()))
+    return 1
+}
+
+// group.Has(name, connId) returns true if connection in group
+func (lib *luaGroupLib) has(L *lua.LState) int {
+    g, err := lib.group(L.CheckString(1))
+    if err != nil {
+        L.Push(lua.LFalse)
+        return 1
+    }
+
+    _, err = g.Get(uint64(L.CheckNumber(2)))
+    L.Push(lua.LBool(err == nil))
+    return 1
+}
+
+// group.Of(connId) returns name of group which connection in, or nil
+func (lib *luaGroupLib) of(L *lua.LState) int {
+    name, _ := lib.groupOf(uint64(L.CheckNumber(1)))
+    if name == "" {
+        L.Push(lua.LNil)
+    } else {
+        L.Push(lua.LString(name))
+    }
+    return 1
+}
+
+// group.Add(name, connId) returns true, or nil and error,
+// connection is moved if it's in other group
+func (lib *luaGroupLib) add(L *lua.LState) int {
+    g, err := lib.group(L.CheckString(1))
+    if err != nil {
+        return pushLuaResult(L, err)
+    }
+    c, err := lib.cm.Connection(uint64(L.CheckNumber(2)))
+    if err != nil {
+        return pushLuaResult(L, err)
+    }
+
+    _, from := lib.groupOf(c.Id())
+    if from == g {
+        return pushLuaResult(L, nil)
+    }
+    if from != nil {
+        return pushLuaResult(L, from.MoveTo(c, g))
+    }
+    return pushLuaResult(L, g.Add(c))
+}
+
+// group.Remove(name, connId) returns true, or nil and error
+func (lib *luaGroupLib) remove(L *lua.LState) int {
+    g, err := lib.group(L.CheckString(1))
+    if err != nil {
+        return pushLuaResult(L, err)
+    }
+    c, err := g.Get(uint64(L.CheckNumber(2)))
+    if err != nil {
+        return pushLuaResult(L, err)
+    }
+
+    return pushLuaResult(L, g.Remove(c))
+}
+
+// group.Move(from, to, connId) returns true, or nil and error
+func (lib *luaGroupLib) move(L *lua.LState) int {
+    from, err := lib.group(L.CheckString(1))
+    if err != nil {
+        return pushLuaResult(L, err)
+    }
+    to, err := lib.group(L.CheckString(2))
+    if err != nil {
+        return pushLuaResult(L, err)
+    }
+    c, err := from.Get(uint64(L.CheckNumber(3)))
+    if err != nil {
+        return pushLuaResult(L, err)
+    }
+
+    return pushLuaResult(L, from.MoveTo(c, to))
+}
+
+// group.Broadcast(name, cmd, msg [, exclude]) returns true, or nil and error,
+// cmd is { mainCmdId, subCmdId } or nil, exclude is array of connection ids
+func (lib *luaGroupLib) broadcast(L *lua.LState) int {
+    g, err := lib.group(L.CheckString(1))
+    if err != nil {
+        return pushLuaResult(L, err)
+    }
+    b, err := encodeLuaMessage(L, 2, 3, lua.LNil)
+    if err != nil {
+        return pushLuaResult(L, err)
+    }
+
+    var exclude []uint64
+    if tb, ok := L.Get(4).(*lua.LTable); ok {
+        tb.ForEach(func(_ lua.LValue, v lua.LValue) {
+            if id, ok := v.(lua.LNumber); ok {
+                exclude = append(exclude, uint64(id))
+            }
+        })
+    }
+
+    g.BroadcastWriteExcept(b, exclude...)
+    return pushLuaResult(L, nil)
+}
+
+// group.SendTo(name, connId, cmd, msg) returns true, or nil and error
+func (lib *luaGroupLib) sendTo(L *lua.LState) int {
+    g, err := lib.group(L.CheckString(1))
+    if err != nil {
+        return pushLuaResult(L, err)
+    }
+    b, err := encodeLuaMessage(L, 3, 4, lua.LNil)
+    if err != nil {
+        return pushLuaResult(L, err)
+    }
+
+    return pushLuaResult(L, g.SendTo(uint64(L.CheckNumber(2)), b))
+}
+
+func (lib *luaGroupLib) group(name string) (gbc.ConnectionGroup, error) {
+    g := lib.cm.Groups.Get(name)
+    if g == nil {
+        return nil, fmt.Errorf("not found group '%s'", name)
+    }
+    return g, nil
+}
+
+func (lib *luaGroupLib) groupOf(id uint64) (string, gbc.ConnectionGroup) {
+    for _, name := range lib.cm.Groups.Names() {
+        g := lib.cm.Groups.Get(name)
+        if g == nil {
+            continue
+        }
+        if _, err := g.Get(id); err == nil {
+            return name, g
+        }
+    }
+    return "", nil
+}
+
+// encode message at index msg with command at index cmd, requestId is nil if message is not a reply
+func encodeLuaMessage(L *lua.LState, cmd int, msg int, requestId lua.LValue) ([]byte, error) {
+    var main, sub lua.LValue = lua.LNil, lua.LNil
+    if tb, ok := L.Get(cmd).(*lua.LTable); ok {
+        main = tb.RawGetString("mainCmdId")
+        if main == lua.LNil {
+            main = tb.RawGetInt(1)
+        }
+        sub = tb.RawGetString("subCmdId")
+        if sub == lua.LNil {
+            sub = tb.RawGetInt(2)
+        }
+    }
+
+    m, err := newCommandMessageFromLua(main, sub, L.Get(msg), requestId)
+    if err != nil {
+        return nil, err
+    }
+    return m.GenBytes(), nil
+}
+
+// push true if err is nil, otherwise push nil and error
+func pushLuaResult(L *lua.LState, err error) int {
+    if err != nil {
+        L.Push(lua.LNil)
+        L.Push(lua.LString(err.Error()))
+        return 2
+    }
+
+    L.Push(lua.LTrue)
+    return 1
+}
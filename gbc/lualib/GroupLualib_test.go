@@ -0,0 +1,92 @@
+package lualib
+
+import (
+    "net"
+    "testing"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc"
+    "github.com/dualface/go-gbc/gbc/impl"
+    "github.com/golang/protobuf/proto"
+    "github.com/golang/protobuf/ptypes/wrappers"
+    "github.com/yuin/gopher-lua"
+)
+
+func TestLuaGroup(t *testing.T) {
+    registerTestStringValue(42, 1)
+
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    cm := impl.NewBasicConnectionManager()
+    go cm.Start(l)
+    defer cm.Stop()
+
+    received := make(chan string, 10)
+    for i := 0; i < 2; i++ {
+        cl, err := impl.DialCommandClient(l.Addr().String(), time.Second)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer cl.Close()
+        cl.OnRawMessage(func(m gbc.RawMessage) error {
+            pb := &wrappers.StringValue{}
+            proto.Unmarshal(m.DataBytes(), pb)
+            received <- pb.Value
+            return nil
+        })
+    }
+    deadline := time.Now().Add(time.Second)
+    for cm.DefaultGroup.Len() < 2 {
+        if time.Now().After(deadline) {
+            t.Fatal("clients not connected")
+        }
+        time.Sleep(time.Millisecond * 5)
+    }
+
+    L := lua.NewState()
+    defer L.Close()
+    LuaGroupLoader(cm, func(gbc.RawMessage) error { return nil })(L)
+    err = L.DoString(`
+        local group = require("group")
+        assert(group.New("room"))
+        local ids = group.Members("` + cm.DefaultGroup.Name + `")
+        assert(#ids == 2)
+        assert(group.Add("room", ids[1]))
+        assert(group.Has("room", ids[1]))
+        assert(group.Len("room") == 1)
+        assert(group.Move("` + cm.DefaultGroup.Name + `", "room", ids[2]))
+        assert(group.Len("room") == 2)
+        assert(group.Broadcast("room", {42, 1}, { value = "all" }, { ids[2] }))
+        assert(group.SendTo("room", ids[2], { mainCmdId = 42, subCmdId = 1 }, { value = "one" }))
+        assert(group.Remove("room", ids[2]))
+        local ok, err = group.SendTo("room", ids[2], {42, 1}, { value = "x" })
+        assert(not ok and err)
+    `)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    got := map[string]bool{}
+    for i := 0; i < 2; i++ {
+        select {
+        case v := <-received:
+            got[v] = true
+        case <-time.After(time.Second):
+            t.Fatalf("received %v", got)
+        }
+    }
+    if !got["all"] || !got["one"] {
+        t.Fatalf("received %v", got)
+    }
+
+    err = L.DoString(`
+        local group = require("group")
+        assert(group.Close("room"))
+        assert(group.Len("room") == nil)
+    `)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
@@ -0,0 +1,487 @@
+package lualib
+
+import (
+    "errors"
+    "fmt"
+    "hash/fnv"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+
+    "github.com/dualface/go-cli-colorlog"
+    "github.com/dualface/go-gbc/gbc"
+    "github.com/yuin/gopher-lua"
+)
+
+var (
+    ErrActorNotFound = errors.New("actor not found")
+    ErrActorExists   = errors.New("actor already exists")
+)
+
+const (
+    luaActorSpawn = iota
+    luaActorMessage
+    luaActorStop
+    luaActorMigrate // stop in old worker and restore in new worker after reloading
+    luaActorRestore
+    luaWorkerMessage // message sent to worker, not to actor
+)
+
+// create actor by factory, restore snapshot, then report actor to Go
+const luaActorSpawnFunc = `
+local factory, id, args, snapshot, set = ...
+local actor
+if type(factory) == "table" then
+    actor = factory.New(id, args)
+else
+    actor = factory(id, args)
+end
+if snapshot ~= nil and actor.Restore then
+    actor:Restore(snapshot)
+end
+set(actor)
+`
+
+const luaActorMessageFunc = `
+local actor, msg, from, reply = ...
+local result
+if actor.OnMessage then
+    result = actor:OnMessage(msg, from)
+end
+if reply then
+    reply(result)
+end
+`
+
+// stop actor and report snapshot to Go
+const luaActorStopFunc = `
+local actor, done = ...
+if actor.OnStop then
+    actor:OnStop()
+end
+local snapshot
+if actor.Snapshot then
+    snapshot = actor:Snapshot()
+end
+done(snapshot)
+`
+
+type (
+    // called in goroutine of Lua state, snapshot is plain Go value converted by LuaValueToGo
+    OnLuaActorSnapshotFunc func(kind string, id string, snapshot interface{})
+
+    // returns saved snapshot of actor, nil if not exists
+    LoadLuaActorSnapshotFunc func(kind string, id string) interface{}
+
+    // actor known by handler, pinned to worker
+    luaActorRef struct {
+        kind     string
+        id       string
+        workerId string
+        args     interface{}
+    }
+
+    luaActorEvent struct {
+        op       int
+        ref      *luaActorRef
+        msg      interface{}  // plain Go value or gbc.RawMessage
+        from     interface{}  // id of sender actor, number of sender worker, or nil
+        reply    luaReplyFunc // set if sender is waiting for reply
+        snapshot interface{}
+        pending  bool          // spawned after reloading, wait for snapshot from old worker
+        target   *luaScheduler // new worker of migrating actor
+    }
+
+    // actor instance in Lua worker, handles events in mailbox one by one
+    luaActor struct {
+        ref     *luaActorRef
+        obj     lua.LValue
+        mailbox []*luaActorEvent
+        busy    bool
+        pending bool
+        stopped bool
+    }
+
+    // events sent to actors in worker and to worker itself, delivered to RESUME_CHAN in order
+    luaActorInbox struct {
+        events []*luaActorEvent
+        signal chan struct{}
+        mutex  *sync.Mutex
+    }
+)
+
+// spawn actor of kind registered by actor.register(), actor is pinned to worker chosen by id,
+// args is plain Go value passed to factory of actor
+func (h *ConcurrenceLuaHandler) SpawnActor(kind string, id string, args interface{}) error {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    if _, ok := h.actors[id]; ok {
+        return ErrActorExists
+    }
+    ref := &luaActorRef{kind: kind, id: id, workerId: h.actorWorkerId(id), args: args}
+    h.actors[id] = ref
+    h.pool.scheduler(ref.workerId).post(&luaActorEvent{op: luaActorSpawn, ref: ref, snapshot: h.loadActorSnapshot(ref)})
+    return nil
+}
+
+// send message to mailbox of actor, msg is plain Go value or gbc.RawMessage, from is id of sender or empty
+func (h *ConcurrenceLuaHandler) SendToActor(id string, msg interface{}, from string) error {
+    if from == "" {
+        return h.postToActor(id, msg, nil, nil)
+    }
+    return h.postToActor(id, msg, from, nil)
+}
+
+// stop actor after handled messages already in its mailbox
+func (h *ConcurrenceLuaHandler) StopActor(id string) error {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    ref, ok := h.actors[id]
+    if !ok {
+        return ErrActorNotFound
+    }
+    delete(h.actors, id)
+    h.pool.scheduler(ref.workerId).post(&luaActorEvent{op: luaActorStop, ref: ref})
+    return nil
+}
+
+func (h *ConcurrenceLuaHandler) ActorExists(id string) bool {
+    h.mutex.RLock()
+    defer h.mutex.RUnlock()
+
+    _, ok := h.actors[id]
+    return ok
+}
+
+// ids of all actors, sorted
+func (h *ConcurrenceLuaHandler) Actors() []string {
+    h.mutex.RLock()
+    defer h.mutex.RUnlock()
+
+    ids := make([]string, 0, len(h.actors))
+    for id := range h.actors {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    return ids
+}
+
+// private
+
+func (h *ConcurrenceLuaHandler) actorWorkerId(id string) string {
+    hash := fnv.New32a()
+    hash.Write([]byte(id))
+    return strconv.Itoa(int(hash.Sum32()%uint32(h.concurrence)) + 1)
+}
+
+// from is id of sender actor, number of sender worker, or nil
+func (h *ConcurrenceLuaHandler) postToActor(id string, msg interface{}, from interface{}, reply luaReplyFunc) error {
+    h.mutex.RLock()
+    defer h.mutex.RUnlock()
+
+    ref, ok := h.actors[id]
+    if !ok {
+        return ErrActorNotFound
+    }
+    h.pool.scheduler(ref.workerId).post(&luaActorEvent{op: luaActorMessage, ref: ref, msg: msg, from: from, reply: reply})
+    return nil
+}
+
+func (h *ConcurrenceLuaHandler) loadActorSnapshot(ref *luaActorRef) interface{} {
+    if h.LoadActorSnapshot == nil {
+        return nil
+    }
+    return h.LoadActorSnapshot(ref.kind, ref.id)
+}
+
+// send inbound message to actor if ActorKey returns id of existing actor
+func (h *ConcurrenceLuaHandler) routeToActor(m gbc.RawMessage) bool {
+    if h.ActorKey == nil {
+        return false
+    }
+    key := h.ActorKey(m)
+    if key == nil {
+        return false
+    }
+    return h.SendToActor(fmt.Sprint(key), m, "") == nil
+}
+
+// respawn actors pinned to restarted worker, restore from saved snapshot
+func (h *ConcurrenceLuaHandler) respawnActors(p *luaPool, workerId string) {
+    h.mutex.RLock()
+    defer h.mutex.RUnlock()
+
+    s := p.scheduler(workerId)
+    for _, ref := range h.actors {
+        if ref.workerId == workerId {
+            s.post(&luaActorEvent{op: luaActorSpawn, ref: ref, snapshot: h.loadActorSnapshot(ref)})
+        }
+    }
+}
+
+// move actors to new pool, called with h.mutex locked, so messages sent later are queued after spawning
+func (h *ConcurrenceLuaHandler) migrateActors(old *luaPool, p *luaPool) {
+    for _, ref := range h.actors {
+        target := p.scheduler(ref.workerId)
+        target.post(&luaActorEvent{op: luaActorSpawn, ref: ref, pending: true})
+        old.scheduler(ref.workerId).post(&luaActorEvent{op: luaActorMigrate, ref: ref, target: target})
+    }
+}
+
+func newLuaActorInbox() *luaActorInbox {
+    return &luaActorInbox{
+        signal: make(chan struct{}, 1),
+        mutex:  &sync.Mutex{},
+    }
+}
+
+// called by any goroutine, never blocks
+func (s *luaScheduler) post(ev *luaActorEvent) {
+    atomic.AddInt32(&s.posted, 1)
+    s.inbox.mutex.Lock()
+    s.inbox.events = append(s.inbox.events, ev)
+    s.inbox.mutex.Unlock()
+
+    select {
+    case s.inbox.signal <- struct{}{}:
+    default:
+    }
+}
+
+// deliver events in inbox to RESUME_CHAN in order
+func (s *luaScheduler) pumpInbox() {
+    defer s.dropInbox()
+
+    for {
+        select {
+        case <-s.inbox.signal:
+        case <-s.done:
+            return
+        }
+
+        for {
+            s.inbox.mutex.Lock()
+            if len(s.inbox.events) == 0 {
+                s.inbox.mutex.Unlock()
+                break
+            }
+            ev := s.inbox.events[0]
+            s.inbox.events[0] = nil
+            s.inbox.events = s.inbox.events[1:]
+            s.inbox.mutex.Unlock()
+
+            select {
+            case s.resumeChan <- &lua.LUserData{Value: ev}:
+            case <-s.done:
+                s.dropActorEvent(ev)
+                return
+            }
+        }
+    }
+}
+
+func (s *luaScheduler) dropInbox() {
+    s.inbox.mutex.Lock()
+    events := s.inbox.events
+    s.inbox.events = nil
+    s.inbox.mutex.Unlock()
+
+    for _, ev := range events {
+        s.dropActorEvent(ev)
+    }
+}
+
+// event will not be handled by closed worker, new worker of migrating actor loads saved snapshot
+func (s *luaScheduler) dropActorEvent(ev *luaActorEvent) {
+    switch ev.op {
+    case luaActorMigrate:
+        s.forwardSnapshot(ev, s.handler.loadActorSnapshot(ev.ref))
+    case luaWorkerMessage:
+        ev.fail(fmt.Errorf("Lua state %s closed", s.workerId))
+    default:
+        ev.fail(ErrActorNotFound)
+    }
+}
+
+// handle event received from RESUME_CHAN
+func (s *luaScheduler) receiveActorEvent(L *lua.LState, ev *luaActorEvent) {
+    atomic.AddInt32(&s.posted, -1)
+
+    if ev.op == luaWorkerMessage {
+        s.receiveWorkerMessage(L, ev)
+        return
+    }
+
+    a, ok := s.actors[ev.ref.id]
+    switch ev.op {
+    case luaActorSpawn:
+        if ok && !a.stopped {
+            clog.PrintWarn("Lua state %s spawn actor %s failed, %s", s.workerId, ev.ref.id, ErrActorExists)
+            return
+        }
+        a = &luaActor{ref: ev.ref, pending: ev.pending}
+        s.actors[ev.ref.id] = a
+        if !ev.pending {
+            a.mailbox = append(a.mailbox, ev)
+        }
+
+    case luaActorRestore:
+        if !ok || !a.pending {
+            return
+        }
+        a.pending = false
+        ev.op = luaActorSpawn
+        a.mailbox = append([]*luaActorEvent{ev}, a.mailbox...)
+
+    default:
+        if !ok {
+            if ev.op != luaActorMigrate {
+                clog.PrintWarn("Lua state %s drop event of actor %s, %s", s.workerId, ev.ref.id, ErrActorNotFound)
+            }
+            // actor failed in old worker
+            s.dropActorEvent(ev)
+            return
+        }
+        a.mailbox = append(a.mailbox, ev)
+    }
+
+    s.runActor(L, a)
+}
+
+// handle events in mailbox until actor is suspended by async IO
+func (s *luaScheduler) runActor(L *lua.LState, a *luaActor) {
+    for !a.busy && !a.pending && len(a.mailbox) > 0 {
+        ev := a.mailbox[0]
+        a.mailbox[0] = nil
+        a.mailbox = a.mailbox[1:]
+
+        if a.stopped {
+            if ev.op == luaActorSpawn {
+                // spawned again after stopping
+                a.stopped = false
+            } else {
+                ev.fail(ErrActorNotFound)
+                continue
+            }
+        }
+
+        t := s.startActorEvent(L, a, ev)
+        if t == nil {
+            ev.fail(ErrActorNotFound)
+            continue
+        }
+        a.busy = true
+        suspended := false
+        t.done = func(L *lua.LState) {
+            a.busy = false
+            // no effect if replied, OnMessage() failed otherwise
+            ev.fail(fmt.Errorf("actor %s failed to handle message", a.ref.id))
+            if ev.op == luaActorSpawn && a.obj == nil {
+                s.failActor(a, fmt.Errorf("factory of '%s' failed", a.ref.kind))
+            }
+            if suspended {
+                s.runActor(L, a)
+            }
+        }
+        s.step(L, t, nil)
+        if a.busy {
+            // suspended by async IO, continue after finished
+            suspended = true
+            return
+        }
+    }
+
+    if a.stopped && !a.busy && len(a.mailbox) == 0 && s.actors[a.ref.id] == a {
+        delete(s.actors, a.ref.id)
+    }
+}
+
+func (s *luaScheduler) startActorEvent(L *lua.LState, a *luaActor, ev *luaActorEvent) *luaTask {
+    switch ev.op {
+    case luaActorSpawn:
+        factory, ok := s.factories[a.ref.kind]
+        if !ok {
+            s.failActor(a, fmt.Errorf("actor kind '%s' not registered", a.ref.kind))
+            return nil
+        }
+        set := L.NewFunction(func(L *lua.LState) int {
+            a.obj = L.Get(1)
+            return 0
+        })
+        t := s.start(L, s.actorFuncs[luaActorSpawn], []lua.LValue{
+            factory, lua.LString(a.ref.id), GoToLuaValue(L, a.ref.args), GoToLuaValue(L, ev.snapshot), set,
+        })
+        t.actor = a
+        return t
+
+    case luaActorMessage:
+        if a.obj == nil {
+            return nil
+        }
+        var msg lua.LValue
+        if m, ok := ev.msg.(gbc.RawMessage); ok {
+            v, err := s.handler.convertMessageToLuaValue(L, m)
+            if err != nil {
+                s.report(&LuaHandlerError{WorkerId: s.workerId, Err: err})
+                return nil
+            }
+            msg = v
+        } else {
+            msg = GoToLuaValue(L, ev.msg)
+        }
+        t := s.start(L, s.actorFuncs[luaActorMessage], []lua.LValue{a.obj, msg, GoToLuaValue(L, ev.from), s.replyFunc(L, ev)})
+        t.actor = a
+        if tb, ok := msg.(*lua.LTable); ok {
+            t.mainCmdId = int(lua.LVAsNumber(tb.RawGetString("mainCmdId")))
+            t.subCmdId = int(lua.LVAsNumber(tb.RawGetString("subCmdId")))
+        }
+        return t
+
+    default:
+        // stop or migrate
+        a.stopped = true
+        if a.obj == nil {
+            if ev.op == luaActorMigrate {
+                s.forwardSnapshot(ev, nil)
+            }
+            return nil
+        }
+        done := L.NewFunction(func(L *lua.LState) int {
+            snapshot, err := LuaValueToGo(L.Get(1))
+            if err != nil {
+                s.report(&LuaHandlerError{WorkerId: s.workerId, Err: fmt.Errorf("snapshot of actor %s, %s", a.ref.id, err)})
+            } else if snapshot != nil && s.handler.OnActorSnapshot != nil {
+                s.handler.OnActorSnapshot(a.ref.kind, a.ref.id, snapshot)
+            }
+            if ev.op == luaActorMigrate {
+                s.forwardSnapshot(ev, snapshot)
+            }
+            return 0
+        })
+        t := s.start(L, s.actorFuncs[luaActorStop], []lua.LValue{a.obj, done})
+        t.actor = a
+        s.cancelTimers(a.obj)
+        a.obj = nil
+        return t
+    }
+}
+
+func (s *luaScheduler) forwardSnapshot(ev *luaActorEvent, snapshot interface{}) {
+    ev.target.post(&luaActorEvent{op: luaActorRestore, ref: ev.ref, snapshot: snapshot})
+}
+
+// actor failed to spawn, forget it
+func (s *luaScheduler) failActor(a *luaActor, err error) {
+    s.report(&LuaHandlerError{WorkerId: s.workerId, Err: fmt.Errorf("spawn actor %s failed, %s", a.ref.id, err)})
+    a.stopped = true
+
+    h := s.handler
+    h.mutex.Lock()
+    if h.actors[a.ref.id] == a.ref {
+        delete(h.actors, a.ref.id)
+    }
+    h.mutex.Unlock()
+}
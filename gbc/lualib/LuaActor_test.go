@@ -0,0 +1,161 @@
+package lualib
+
+import (
+    "fmt"
+    "os"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc"
+    "github.com/dualface/go-gbc/gbc/impl"
+    "github.com/yuin/gopher-lua"
+)
+
+const testLuaActor = `
+local async = require("async")
+local actor = require("actor")
+
+local Counter = gbc.Class("Counter", gbc.Actor)
+
+function Counter:Constructor(id, args)
+    Counter.super.Constructor(self, id, args)
+    self.n = args and args.start or 0
+end
+
+function Counter:OnMessage(msg, from)
+    if from == nil and msg.msg then
+        RECORD(self.id .. ":inbound:" .. msg.msg.Value)
+        return
+    end
+    if msg.op == "add" then
+        self.n = self.n + msg.v
+    elseif msg.op == "slow" then
+        async.sleep(0.1)
+        self.n = self.n + 100
+    elseif msg.op == "get" then
+        RECORD(self.id .. ":" .. self.n .. ":" .. tostring(from) .. ":" .. WORKER.VERSION)
+    elseif msg.op == "poke" then
+        self:Send(msg.to, { op = "get" })
+    elseif msg.op == "whoami" then
+        RECORD("self:" .. tostring(actor.self()))
+    end
+end
+
+function Counter:Snapshot()
+    return { n = self.n }
+end
+
+function Counter:Restore(snapshot)
+    self.n = snapshot.n
+end
+
+function Counter:OnStop()
+    RECORD(self.id .. ":stop")
+end
+
+gbc.Actor.Register("counter", Counter)
+`
+
+func TestLuaActor(t *testing.T) {
+    registerTestStringValue(48, 1)
+    dir := newTestLuaDir(t, testLuaActor)
+    defer os.RemoveAll(dir)
+
+    records := make(chan string, 10)
+    saved := &sync.Map{}
+    h := NewConcurrenceLuaHandler(3, dir, "main.lua")
+    h.RegisterModuleLoader(LuaProtoLoader)
+    h.RegisterGlobalFunc("RECORD", func(L *lua.LState) int {
+        records <- L.CheckString(1)
+        return 0
+    })
+    h.ActorKey = func(m gbc.RawMessage) interface{} {
+        if m.(*impl.CommandMessage).MainCmdId() == 48 {
+            return "a"
+        }
+        return nil
+    }
+    h.OnActorSnapshot = func(kind string, id string, snapshot interface{}) {
+        saved.Store(id, snapshot)
+    }
+    h.LoadActorSnapshot = func(kind string, id string) interface{} {
+        v, _ := saved.Load(id)
+        return v
+    }
+    h.Start()
+
+    expect := func(want string) {
+        t.Helper()
+        select {
+        case r := <-records:
+            if r != want {
+                t.Fatalf("expected %s, got %s", want, r)
+            }
+        case <-time.After(time.Second * 2):
+            t.Fatalf("expected %s, got nothing", want)
+        }
+    }
+
+    if err := h.SpawnActor("counter", "a", map[string]interface{}{"start": 1}); err != nil {
+        t.Fatal(err)
+    }
+    if err := h.SpawnActor("counter", "a", nil); err != ErrActorExists {
+        t.Fatalf("spawned actor twice, %v", err)
+    }
+    h.SpawnActor("counter", "b", nil)
+
+    // messages are handled in order, even if handler is suspended
+    h.SendToActor("a", map[string]interface{}{"op": "add", "v": 2}, "")
+    h.SendToActor("a", map[string]interface{}{"op": "slow"}, "")
+    h.SendToActor("a", map[string]interface{}{"op": "get"}, "")
+    expect("a:103:nil:1")
+
+    h.SendToActor("b", map[string]interface{}{"op": "poke", "to": "a"}, "")
+    expect("a:103:b:1")
+    h.SendToActor("b", map[string]interface{}{"op": "whoami"}, "")
+    expect("self:b")
+
+    // inbound message routed by ActorKey
+    h.ReceiveRawMessage(impl.NewCommandMessageFromData(48, 1, impl.CommandMessageProtobufType, marshalTestStringValue("hi")))
+    expect("a:inbound:hi")
+
+    // actors are moved to new Lua states with snapshot after reloading, messages keep order
+    h.SendToActor("a", map[string]interface{}{"op": "slow"}, "")
+    if err := h.Reload(); err != nil {
+        t.Fatal(err)
+    }
+    h.SendToActor("a", map[string]interface{}{"op": "add", "v": 1}, "")
+    h.SendToActor("a", map[string]interface{}{"op": "get"}, "")
+    got := map[string]bool{}
+    for i := 0; i < 3; i++ {
+        select {
+        case r := <-records:
+            got[r] = true
+        case <-time.After(time.Second * 2):
+            t.Fatalf("got %v", got)
+        }
+    }
+    if !got["a:stop"] || !got["b:stop"] || !got["a:204:nil:2"] {
+        t.Fatalf("got %v", got)
+    }
+
+    // stopping saves snapshot, spawning again restores it
+    h.StopActor("a")
+    expect("a:stop")
+    if err := h.SendToActor("a", nil, ""); err != ErrActorNotFound {
+        t.Fatalf("sent to stopped actor, %v", err)
+    }
+    deadline := time.Now().Add(time.Second)
+    for h.ActorExists("a") && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond * 5)
+    }
+    if err := h.SpawnActor("counter", "a", nil); err != nil {
+        t.Fatal(err)
+    }
+    h.SendToActor("a", map[string]interface{}{"op": "get"}, "")
+    expect("a:204:nil:2")
+    if actors := fmt.Sprint(h.Actors()); actors != "[a b]" {
+        t.Fatalf("actors %s", actors)
+    }
+}
@@ -0,0 +1,63 @@
+package lualib
+
+import (
+    "context"
+    "errors"
+    "fmt"
+)
+
+var (
+    // returned when Lua handler executed too many instructions for one message
+    ErrInstructionBudgetExceeded = errors.New("instruction budget exceeded")
+)
+
+type (
+    // error raised by Lua handler when handling message
+    LuaHandlerError struct {
+        WorkerId  string
+        MainCmdId int
+        SubCmdId  int
+        Err       error
+        // Lua stack traceback, empty if error raised before calling handler
+        Traceback string
+    }
+
+    OnLuaHandlerErrorFunc func(err *LuaHandlerError)
+
+    // gopher-lua checks Done() of context before each instruction, so Done() counts instructions
+    instructionBudgetContext struct {
+        context.Context
+        budget int64
+        count  int64
+    }
+)
+
+var closedDoneChan = make(chan struct{})
+
+func init() {
+    close(closedDoneChan)
+}
+
+func (e *LuaHandlerError) Error() string {
+    if e.MainCmdId == 0 && e.SubCmdId == 0 {
+        // not handling inbound message, e.g. timer or actor event
+        return fmt.Sprintf("Lua state %s failed, %s", e.WorkerId, e.Err)
+    }
+    return fmt.Sprintf("Lua state %s handle command %d:%d failed, %s", e.WorkerId, e.MainCmdId, e.SubCmdId, e.Err)
+}
+
+// only called by goroutine of Lua state
+func (c *instructionBudgetContext) Done() <-chan struct{} {
+    c.count++
+    if c.count > c.budget {
+        return closedDoneChan
+    }
+    return c.Context.Done()
+}
+
+func (c *instructionBudgetContext) Err() error {
+    if c.count > c.budget {
+        return ErrInstructionBudgetExceeded
+    }
+    return c.Context.Err()
+}
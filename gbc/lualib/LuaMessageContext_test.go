@@ -0,0 +1,92 @@
+package lualib
+
+import (
+    "os"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc/impl"
+    "github.com/yuin/gopher-lua"
+)
+
+// send a message spinning forever, then a normal message, returns error of aborted handler
+func runAbortedHandler(t *testing.T, setup func(h *ConcurrenceLuaHandler)) *LuaHandlerError {
+    registerTestStringValue(45, 1)
+    dir := newTestLuaDir(t, `
+local function spin()
+    while true do end
+end
+
+function gbc.MessageHandler:ReceiveProtoMessage(msg)
+    if msg.msg.Value == "spin" then
+        spin()
+    end
+    RECORD(WORKER.ID, msg.msg.Value)
+end
+`)
+    defer os.RemoveAll(dir)
+
+    records := make(chan string, 10)
+    errs := make(chan *LuaHandlerError, 10)
+    h := NewConcurrenceLuaHandler(1, dir, "main.lua")
+    setup(h)
+    h.OnError = func(err *LuaHandlerError) {
+        errs <- err
+    }
+    h.RegisterModuleLoader(LuaProtoLoader)
+    h.RegisterGlobalFunc("RECORD", func(L *lua.LState) int {
+        records <- L.CheckString(1) + ":" + L.CheckString(2)
+        return 0
+    })
+    h.Start()
+
+    send := func(v string) {
+        h.ReceiveRawMessage(impl.NewCommandMessageFromData(45, 1, impl.CommandMessageProtobufType, marshalTestStringValue(v)))
+    }
+    send("spin")
+    var err *LuaHandlerError
+    select {
+    case err = <-errs:
+    case <-time.After(time.Second * 3):
+        t.Fatal("handler not aborted")
+    }
+
+    // the only worker returns to pool without restarting
+    send("ok")
+    select {
+    case r := <-records:
+        if r != "1:ok" {
+            t.Fatalf("handled by %s", r)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("worker not returned to pool")
+    }
+    if n := h.Restarts()["1"]; n != 0 {
+        t.Fatalf("worker restarted %d times", n)
+    }
+
+    if err.MainCmdId != 45 || err.SubCmdId != 1 || !strings.Contains(err.Traceback, "spin") {
+        t.Fatalf("invalid error %+v", err)
+    }
+    return err
+}
+
+func TestLuaMessageTimeout(t *testing.T) {
+    start := time.Now()
+    err := runAbortedHandler(t, func(h *ConcurrenceLuaHandler) {
+        h.MessageTimeout = time.Millisecond * 100
+    })
+    if !strings.Contains(err.Error(), "deadline") || time.Since(start) > time.Second {
+        t.Fatalf("aborted by %s after %s", err, time.Since(start))
+    }
+}
+
+func TestLuaInstructionBudget(t *testing.T) {
+    err := runAbortedHandler(t, func(h *ConcurrenceLuaHandler) {
+        h.InstructionBudget = 100000
+    })
+    if !strings.Contains(err.Error(), ErrInstructionBudgetExceeded.Error()) {
+        t.Fatalf("aborted by %s", err)
+    }
+}
@@ -0,0 +1,363 @@
+package lualib
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "sync/atomic"
+
+    "github.com/dualface/go-gbc/gbc"
+    "github.com/dualface/go-gbc/gbc/impl"
+    "github.com/yuin/gopher-lua"
+)
+
+const (
+    // max number of messages suspended by async IO in one Lua worker
+    DefaultLuaMaxSuspended = 100
+
+    luaSchedulerKey = "gbc.scheduler"
+)
+
+// start coroutine with arguments and yield at once, so Panic of coroutine can be replaced before running fn
+const luaTaskBootstrap = `
+local n = select("#", ...)
+local args = {...}
+coroutine.yield()
+return args[1](unpack(args, 2, n))
+`
+
+type (
+    // called in its own goroutine, must not access Lua state, result is converted by GoToLuaValue
+    LuaAsyncFunc func(ctx context.Context, args []interface{}) (interface{}, error)
+
+    // runs message handlers of one Lua worker in coroutines, all methods except deliver
+    // are called by goroutine of Lua state
+    luaScheduler struct {
+        handler    *ConcurrenceLuaHandler
+        workerId   string
+        L          *lua.LState
+        bootstrap  *lua.LFunction
+        traceback  lua.LValue
+        tasks      map[*lua.LState]*luaTask
+        timers     map[int]*luaTimer
+        lastTimer  int
+        actors     map[string]*luaActor
+        factories  map[string]lua.LValue // actor factories registered by actor.register()
+        actorFuncs map[int]*lua.LFunction
+        onMessage  *lua.LFunction // handler of messages sent to worker, set by worker.onMessage()
+        inbox      *luaActorInbox
+        posted     int32 // events posted to inbox but not handled
+        withheld   bool  // worker was full after handling message, id is not sent to WORKER_CHAN yet
+        resumeChan chan lua.LValue
+        done       chan struct{}
+        closeOnce  *sync.Once
+    }
+
+    // message handler running in coroutine
+    luaTask struct {
+        thread    *lua.LState
+        ctx       context.Context // cancelled when task finished or timeout
+        cancel    context.CancelFunc
+        mainCmdId int
+        subCmdId  int
+        traceback string
+        waiting   bool      // waiting for async function
+        actor     *luaActor // actor which coroutine handles event for
+        done      func(L *lua.LState)
+    }
+
+    luaAsyncResult struct {
+        task  *luaTask
+        value interface{}
+        err   error
+    }
+)
+
+func newLuaScheduler(h *ConcurrenceLuaHandler, L *lua.LState, workerId string) *luaScheduler {
+    s := &luaScheduler{
+        handler:    h,
+        workerId:   workerId,
+        L:          L,
+        traceback:  L.GetField(L.GetGlobal("debug"), "traceback"),
+        tasks:      make(map[*lua.LState]*luaTask),
+        timers:     make(map[int]*luaTimer),
+        actors:     make(map[string]*luaActor),
+        factories:  make(map[string]lua.LValue),
+        actorFuncs: make(map[int]*lua.LFunction),
+        inbox:      newLuaActorInbox(),
+        resumeChan: make(chan lua.LValue),
+        done:       make(chan struct{}),
+        closeOnce:  &sync.Once{},
+    }
+
+    s.bootstrap = mustLoadLuaString(L, luaTaskBootstrap)
+    s.actorFuncs[luaActorSpawn] = mustLoadLuaString(L, luaActorSpawnFunc)
+    s.actorFuncs[luaActorMessage] = mustLoadLuaString(L, luaActorMessageFunc)
+    s.actorFuncs[luaActorStop] = mustLoadLuaString(L, luaActorStopFunc)
+    s.actorFuncs[luaWorkerMessage] = mustLoadLuaString(L, luaWorkerMessageFunc)
+
+    L.G.Registry.RawSetString(luaSchedulerKey, &lua.LUserData{Value: s})
+    go s.pumpInbox()
+    return s
+}
+
+// run f in its own goroutine and suspend the calling coroutine until f returns,
+// then returns result of f, or nil and error to Lua.
+// Go function called by Lua must return Await() directly, e.g. return lualib.Await(L, f),
+// raise error if L is Lua worker but not a coroutine of message handler, e.g. main chunk,
+// waiting there blocks the worker, f is called synchronously if L is not Lua worker
+func Await(L *lua.LState, f func(ctx context.Context) (interface{}, error)) int {
+    s := luaSchedulerOf(L)
+    if s == nil {
+        v, err := f(context.Background())
+        return pushAsyncResult(L, v, err)
+    }
+
+    t := s.tasks[L]
+    if t == nil || t.waiting {
+        L.RaiseError("can't wait outside coroutine of message handler, worker would be blocked")
+    }
+
+    t.waiting = true
+    go s.wait(t, f)
+    return L.Yield()
+}
+
+// private
+
+func luaSchedulerOf(L *lua.LState) *luaScheduler {
+    ud, ok := L.G.Registry.RawGetString(luaSchedulerKey).(*lua.LUserData)
+    if !ok {
+        return nil
+    }
+    s, _ := ud.Value.(*luaScheduler)
+    return s
+}
+
+func mustLoadLuaString(L *lua.LState, source string) *lua.LFunction {
+    fn, err := L.LoadString(source)
+    if err != nil {
+        panic(err)
+    }
+    return fn
+}
+
+func pushAsyncResult(L *lua.LState, v interface{}, err error) int {
+    if err != nil {
+        L.Push(lua.LNil)
+        L.Push(lua.LString(err.Error()))
+        return 2
+    }
+    L.Push(GoToLuaValue(L, v))
+    return 1
+}
+
+// WORKER.HANDLE(fn, self, msg) calls fn(self, msg) in new coroutine with limits of MessageTimeout and InstructionBudget,
+// msg received from INPUT_CHAN is converted to table, returns true if worker can accept next message
+func (s *luaScheduler) handle(L *lua.LState) int {
+    fn := L.CheckFunction(1)
+    self := L.Get(2)
+    msg := L.Get(3)
+
+    var mainCmdId, subCmdId int
+    if ud, ok := msg.(*lua.LUserData); ok {
+        if m, ok := ud.Value.(*impl.CommandMessage); ok {
+            mainCmdId = int(m.MainCmdId())
+            subCmdId = int(m.SubCmdId())
+        }
+        if m, ok := ud.Value.(gbc.RawMessage); ok {
+            v, err := s.handler.convertMessageToLuaValue(L, m)
+            if err != nil {
+                s.report(&LuaHandlerError{WorkerId: s.workerId, MainCmdId: mainCmdId, SubCmdId: subCmdId, Err: err})
+                L.Push(lua.LBool(s.handled()))
+                return 1
+            }
+            msg = v
+        }
+    } else if tb, ok := msg.(*lua.LTable); ok {
+        mainCmdId = int(lua.LVAsNumber(tb.RawGetString("mainCmdId")))
+        subCmdId = int(lua.LVAsNumber(tb.RawGetString("subCmdId")))
+    }
+
+    t := s.start(L, fn, []lua.LValue{self, msg})
+    t.mainCmdId = mainCmdId
+    t.subCmdId = subCmdId
+    s.step(L, t, nil)
+
+    L.Push(lua.LBool(s.handled()))
+    return 1
+}
+
+// WORKER.RESUME(ev) resumes coroutine or runs timer callback with event received from RESUME_CHAN,
+// returns true if id of worker was withheld because worker was full, and worker can accept next message now
+func (s *luaScheduler) resume(L *lua.LState) int {
+    switch ev := L.CheckUserData(1).Value.(type) {
+    case *luaAsyncResult:
+        if s.tasks[ev.task.thread] != ev.task {
+            break
+        }
+        ev.task.waiting = false
+        var values []lua.LValue
+        if ev.err != nil {
+            values = []lua.LValue{lua.LNil, lua.LString(ev.err.Error())}
+        } else if ev.value != nil {
+            values = []lua.LValue{GoToLuaValue(L, ev.value)}
+        }
+        s.step(L, ev.task, values)
+
+    case *luaTimer:
+        if s.timers[ev.id] != ev {
+            // cancelled
+            break
+        }
+        if ev.once {
+            delete(s.timers, ev.id)
+        }
+        s.step(L, s.start(L, ev.fn, []lua.LValue{lua.LNumber(ev.id)}), nil)
+
+    case *luaActorEvent:
+        s.receiveActorEvent(L, ev)
+    }
+
+    idle := s.withheld && !s.full()
+    if idle {
+        s.withheld = false
+    }
+    L.Push(lua.LBool(idle))
+    return 1
+}
+
+// WORKER.PENDING() returns number of suspended coroutines and actor events not handled
+func (s *luaScheduler) pending(L *lua.LState) int {
+    L.Push(lua.LNumber(len(s.tasks) + int(atomic.LoadInt32(&s.posted))))
+    return 1
+}
+
+// create coroutine for fn, started by step()
+func (s *luaScheduler) start(L *lua.LState, fn *lua.LFunction, args []lua.LValue) *luaTask {
+    th, _ := s.L.NewThread()
+    t := &luaTask{thread: th}
+    h := s.handler
+    if h.MessageTimeout > 0 {
+        t.ctx, t.cancel = context.WithTimeout(context.Background(), h.MessageTimeout)
+    } else {
+        t.ctx, t.cancel = context.WithCancel(context.Background())
+    }
+    if h.InstructionBudget > 0 {
+        th.SetContext(&instructionBudgetContext{Context: t.ctx, budget: h.InstructionBudget})
+    } else if h.MessageTimeout > 0 {
+        th.SetContext(t.ctx)
+    }
+    s.tasks[th] = t
+
+    L.Resume(th, s.bootstrap, append([]lua.LValue{fn}, args...)...)
+    th.Panic = func(th *lua.LState) {
+        // keep traceback before coroutine is killed
+        t.traceback = s.stackTrace(th)
+        panic(&lua.ApiError{Type: lua.ApiErrorRun, Object: th.Get(-1)})
+    }
+    return t
+}
+
+// run coroutine until it yields or finishes
+func (s *luaScheduler) step(L *lua.LState, t *luaTask, values []lua.LValue) {
+    state, err, _ := L.Resume(t.thread, nil, values...)
+    switch state {
+    case lua.ResumeYield:
+        if !t.waiting {
+            // yielded by coroutine.yield(), continue after other events
+            go s.deliver(&luaAsyncResult{task: t})
+        }
+        return
+
+    case lua.ResumeError:
+        herr := &LuaHandlerError{
+            WorkerId:  s.workerId,
+            MainCmdId: t.mainCmdId,
+            SubCmdId:  t.subCmdId,
+            Err:       err,
+            Traceback: t.traceback,
+        }
+        if apiErr, ok := err.(*lua.ApiError); ok {
+            herr.Err = fmt.Errorf("%s", apiErr.Object.String())
+        }
+        s.report(herr)
+    }
+
+    delete(s.tasks, t.thread)
+    t.cancel()
+    if t.done != nil {
+        t.done(L)
+    }
+}
+
+// wait for f in its own goroutine, abort waiting if task timeout
+func (s *luaScheduler) wait(t *luaTask, f func(ctx context.Context) (interface{}, error)) {
+    ch := make(chan *luaAsyncResult, 1)
+    go func() {
+        v, err := f(t.ctx)
+        ch <- &luaAsyncResult{task: t, value: v, err: err}
+    }()
+
+    select {
+    case r := <-ch:
+        s.deliver(r)
+    case <-t.ctx.Done():
+        s.deliver(&luaAsyncResult{task: t, err: t.ctx.Err()})
+    }
+}
+
+// send event to RESUME_CHAN, called by any goroutine
+func (s *luaScheduler) deliver(ev interface{}) {
+    select {
+    case s.resumeChan <- &lua.LUserData{Value: ev}:
+    case <-s.done:
+    }
+}
+
+// called after message got from INPUT_CHAN is handled or suspended,
+// returns true if worker can accept next message, otherwise id of worker is withheld until RESUME returns true
+func (s *luaScheduler) handled() bool {
+    if s.full() {
+        s.withheld = true
+        return false
+    }
+    return true
+}
+
+func (s *luaScheduler) full() bool {
+    max := s.handler.MaxSuspended
+    if max <= 0 {
+        max = DefaultLuaMaxSuspended
+    }
+    return len(s.tasks) >= max
+}
+
+func (s *luaScheduler) stackTrace(th *lua.LState) string {
+    err := s.L.CallByParam(lua.P{Fn: s.traceback, NRet: 1, Protect: true}, th, lua.LNumber(0))
+    if err != nil {
+        return ""
+    }
+    tb := s.L.Get(-1).String()
+    s.L.Pop(1)
+    return tb
+}
+
+func (s *luaScheduler) report(err *LuaHandlerError) {
+    s.handler.reportError(err)
+}
+
+// called after main loop of Lua state returned, drop all suspended coroutines and timers
+func (s *luaScheduler) close() {
+    s.closeOnce.Do(func() {
+        close(s.done)
+        for _, t := range s.tasks {
+            t.cancel()
+        }
+        s.tasks = make(map[*lua.LState]*luaTask)
+        for _, t := range s.timers {
+            close(t.stop)
+        }
+        s.timers = make(map[int]*luaTimer)
+    })
+}
@@ -0,0 +1,102 @@
+package lualib
+
+import (
+    "os"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc/impl"
+    "github.com/yuin/gopher-lua"
+)
+
+func TestLuaSchedulerWithheldWorker(t *testing.T) {
+    registerTestStringValue(46, 1)
+    dir := newTestLuaDir(t, `
+local async = require("async")
+local timer = require("timer")
+
+-- worker is full while timer callback is suspended, but id of worker was not withheld
+timer.after(0, function()
+    async.sleep(0.05)
+    RECORD("slept")
+end)
+
+function gbc.MessageHandler:ReceiveProtoMessage(msg)
+    RECORD(msg.msg.Value)
+    if msg.msg.Value == "wait" then
+        async.sleep(0.05)
+        RECORD("waited")
+    end
+end
+`)
+    defer os.RemoveAll(dir)
+
+    records := make(chan string, 10)
+    h := NewConcurrenceLuaHandler(1, dir, "main.lua")
+    h.MaxSuspended = 1
+    h.RegisterModuleLoader(LuaProtoLoader)
+    h.RegisterGlobalFunc("RECORD", func(L *lua.LState) int {
+        records <- L.CheckString(1)
+        return 0
+    })
+    h.Start()
+
+    expect := func(want string) {
+        t.Helper()
+        select {
+        case r := <-records:
+            if r != want {
+                t.Fatalf("expected %s, got %s", want, r)
+            }
+        case <-time.After(time.Second):
+            t.Fatalf("expected %s, got nothing", want)
+        }
+    }
+    expect("slept")
+
+    // only one id of worker in WORKER_CHAN
+    if n := len(h.pool.availLuaStates); n != 1 {
+        t.Fatalf("%d ids of worker available", n)
+    }
+
+    // id of full worker is withheld until suspended message finished
+    send := func(v string) {
+        h.ReceiveRawMessage(impl.NewCommandMessageFromData(46, 1, impl.CommandMessageProtobufType, marshalTestStringValue(v)))
+    }
+    send("wait")
+    expect("wait")
+    send("next")
+    expect("waited")
+    expect("next")
+    if n := len(h.pool.availLuaStates); n != 1 {
+        t.Fatalf("%d ids of worker available", n)
+    }
+}
+
+func TestLuaSchedulerAwaitInMainChunk(t *testing.T) {
+    dir := newTestLuaDir(t, `
+local workers = require("worker")
+local ok, err = pcall(workers.call, 1, "hello")
+RECORD(tostring(ok), tostring(err))
+`)
+    defer os.RemoveAll(dir)
+
+    records := make(chan string, 10)
+    h := NewConcurrenceLuaHandler(1, dir, "main.lua")
+    h.RegisterModuleLoader(LuaProtoLoader)
+    h.RegisterGlobalFunc("RECORD", func(L *lua.LState) int {
+        records <- L.CheckString(1) + ":" + L.CheckString(2)
+        return 0
+    })
+    h.Start()
+
+    select {
+    case r := <-records:
+        if !strings.HasPrefix(r, "false:") || !strings.Contains(r, "outside coroutine") {
+            t.Fatalf("calling worker in main chunk returns %s", r)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("calling worker in main chunk is blocked")
+    }
+}
@@ -0,0 +1,257 @@
+package lualib
+
+import (
+    "fmt"
+    "reflect"
+    "sort"
+
+    "github.com/yuin/gopher-lua"
+)
+
+type (
+    // returns data shared by all Lua states, values are plain Go values like results of LuaValueToGo,
+    // structs are copied by exported fields, pointers are dereferenced
+    LoadLuaSharedDataFunc func() (map[string]interface{}, error)
+
+    // immutable version of shared data, replaced as a whole
+    luaSharedData struct {
+        version int
+        root    *luaSharedTable
+    }
+
+    // immutable copy of map or slice, read by Lua states concurrently without locking
+    luaSharedTable struct {
+        items   []interface{}           // copy of slice, indexed from 1 in Lua
+        fields  map[string]interface{}  // string keys of map and fields of struct
+        numbers map[float64]interface{} // number keys of map
+        keys    []lua.LValue            // sorted keys, numbers first, order of shared.pairs()
+    }
+
+    // pointer, map or slice being copied by freezeSharedValue
+    luaSharedRef struct {
+        t reflect.Type
+        p uintptr
+    }
+)
+
+// replace shared data of Lua states atomically, data is copied, returns new version,
+// Lua code holding old tables keeps reading old version
+func (h *ConcurrenceLuaHandler) SetSharedData(data map[string]interface{}) int {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    shared := h.newSharedData(data)
+    h.pool.shared.Store(shared)
+    return shared.version
+}
+
+// version of shared data used by running scripts, zero if never set
+func (h *ConcurrenceLuaHandler) SharedDataVersion() int {
+    h.mutex.RLock()
+    defer h.mutex.RUnlock()
+    return h.pool.sharedData().version
+}
+
+// run Lua file in temporary Lua state and copy the returned table, e.g. LoadSharedData of handler
+func LoadLuaSharedData(filename string) (map[string]interface{}, error) {
+    L := lua.NewState()
+    defer L.Close()
+
+    err := L.DoFile(filename)
+    if err != nil {
+        return nil, err
+    }
+    v, err := LuaValueToGo(L.Get(-1))
+    if err != nil {
+        return nil, fmt.Errorf("load shared data from %s failed, %s", filename, err)
+    }
+    if v == nil {
+        return map[string]interface{}{}, nil
+    }
+    data, ok := v.(map[string]interface{})
+    if !ok {
+        return nil, fmt.Errorf("load shared data from %s failed, table with string keys expected", filename)
+    }
+    return data, nil
+}
+
+// private
+
+// called with h.mutex locked
+func (h *ConcurrenceLuaHandler) newSharedData(data map[string]interface{}) *luaSharedData {
+    h.lastSharedVersion++
+    root, _ := freezeSharedValue(data, make(map[luaSharedRef]bool)).(*luaSharedTable)
+    if root == nil {
+        root = &luaSharedTable{fields: map[string]interface{}{}}
+    }
+    return &luaSharedData{version: h.lastSharedVersion, root: root}
+}
+
+// load shared data by LoadSharedData, returns nil if not set
+func (h *ConcurrenceLuaHandler) loadSharedData() (map[string]interface{}, error) {
+    if h.LoadSharedData == nil {
+        return nil, nil
+    }
+    data, err := h.LoadSharedData()
+    if err != nil {
+        return nil, err
+    }
+    if data == nil {
+        data = map[string]interface{}{}
+    }
+    return data, nil
+}
+
+func (p *luaPool) sharedData() *luaSharedData {
+    return p.shared.Load().(*luaSharedData)
+}
+
+// copy maps, slices and structs to luaSharedTable, numbers are converted to float64,
+// functions, channels and circular references can't be shared, they are converted to nil
+func freezeSharedValue(v interface{}, visited map[luaSharedRef]bool) interface{} {
+    switch vv := v.(type) {
+    case nil, bool, string, float64, *luaSharedTable:
+        return v
+    case []byte:
+        return string(vv)
+    }
+
+    rv := reflect.ValueOf(v)
+    switch rv.Kind() {
+    case reflect.Ptr, reflect.Map, reflect.Slice:
+        if rv.IsNil() {
+            return nil
+        }
+        ref := luaSharedRef{t: rv.Type(), p: rv.Pointer()}
+        if visited[ref] {
+            return nil
+        }
+        visited[ref] = true
+        defer delete(visited, ref)
+    }
+
+    switch rv.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return float64(rv.Int())
+
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return float64(rv.Uint())
+
+    case reflect.Bool:
+        return rv.Bool()
+
+    case reflect.Float32, reflect.Float64:
+        return rv.Float()
+
+    case reflect.String:
+        return rv.String()
+
+    case reflect.Slice, reflect.Array:
+        items := make([]interface{}, rv.Len())
+        for i := range items {
+            items[i] = freezeSharedValue(rv.Index(i).Interface(), visited)
+        }
+        return &luaSharedTable{items: items}
+
+    case reflect.Map:
+        t := &luaSharedTable{
+            fields:  make(map[string]interface{}),
+            numbers: make(map[float64]interface{}),
+            keys:    make([]lua.LValue, 0, rv.Len()),
+        }
+        for _, key := range rv.MapKeys() {
+            v := freezeSharedValue(rv.MapIndex(key).Interface(), visited)
+            switch k := freezeSharedValue(key.Interface(), visited).(type) {
+            case float64:
+                t.numbers[k] = v
+                t.keys = append(t.keys, lua.LNumber(k))
+            case string:
+                t.fields[k] = v
+                t.keys = append(t.keys, lua.LString(k))
+            default:
+                // Lua code can't read other keys by t[key]
+                s := fmt.Sprint(key.Interface())
+                t.fields[s] = v
+                t.keys = append(t.keys, lua.LString(s))
+            }
+        }
+        sortSharedKeys(t.keys)
+        return t
+
+    case reflect.Ptr:
+        return freezeSharedValue(rv.Elem().Interface(), visited)
+
+    case reflect.Struct:
+        // wrapped by luar, struct would be mutable and share memory with Go code
+        rt := rv.Type()
+        t := &luaSharedTable{
+            fields: make(map[string]interface{}, rt.NumField()),
+            keys:   make([]lua.LValue, 0, rt.NumField()),
+        }
+        for i := 0; i < rt.NumField(); i++ {
+            f := rt.Field(i)
+            if f.PkgPath != "" {
+                // unexported
+                continue
+            }
+            t.fields[f.Name] = freezeSharedValue(rv.Field(i).Interface(), visited)
+            t.keys = append(t.keys, lua.LString(f.Name))
+        }
+        sortSharedKeys(t.keys)
+        return t
+
+    default:
+        return nil
+    }
+}
+
+// number keys before string keys
+func sortSharedKeys(keys []lua.LValue) {
+    sort.Slice(keys, func(i, j int) bool {
+        ni, iok := keys[i].(lua.LNumber)
+        nj, jok := keys[j].(lua.LNumber)
+        if iok && jok {
+            return ni < nj
+        }
+        if iok || jok {
+            return iok
+        }
+        return keys[i].(lua.LString) < keys[j].(lua.LString)
+    })
+}
+
+// key is index of items, number key or string key of map
+func (t *luaSharedTable) get(key lua.LValue) interface{} {
+    switch k := key.(type) {
+    case lua.LNumber:
+        if t.items != nil {
+            i := int(k)
+            if float64(i) == float64(k) && i >= 1 && i <= len(t.items) {
+                return t.items[i-1]
+            }
+            return nil
+        }
+        return t.numbers[float64(k)]
+
+    case lua.LString:
+        if t.fields != nil {
+            return t.fields[string(k)]
+        }
+    }
+    return nil
+}
+
+// returns key and value after index n of iteration, false if finished
+func (t *luaSharedTable) at(n int) (lua.LValue, interface{}, bool) {
+    if t.items != nil {
+        if n >= len(t.items) {
+            return lua.LNil, nil, false
+        }
+        return lua.LNumber(n + 1), t.items[n], true
+    }
+    if n >= len(t.keys) {
+        return lua.LNil, nil, false
+    }
+    key := t.keys[n]
+    return key, t.get(key), true
+}
@@ -0,0 +1,78 @@
+package lualib
+
+import (
+    "sync/atomic"
+    "testing"
+
+    "github.com/yuin/gopher-lua"
+)
+
+func newTestSharedState(data map[string]interface{}) *lua.LState {
+    p := &luaPool{shared: &atomic.Value{}}
+    root, _ := freezeSharedValue(data, make(map[luaSharedRef]bool)).(*luaSharedTable)
+    p.shared.Store(&luaSharedData{version: 1, root: root})
+
+    L := lua.NewState()
+    L.PreloadModule("shared", luaSharedLoader(p))
+    return L
+}
+
+func TestLuaSharedDataKeyTypes(t *testing.T) {
+    L := newTestSharedState(map[string]interface{}{
+        "items": map[interface{}]interface{}{1.0: "number", "1": "string", "a": true, 2: "int"},
+        "ids":   map[int]string{1001: "sword", 1002: "shield"},
+    })
+    defer L.Close()
+
+    err := L.DoString(`
+        local shared = require("shared")
+        local items = shared.get("items")
+        assert(items[1] == "number" and items["1"] == "string" and items[2] == "int" and items.a == true)
+
+        local keys = {}
+        for k, v in shared.pairs(items) do
+            keys[#keys + 1] = type(k) .. ":" .. tostring(k)
+        end
+        assert(table.concat(keys, ",") == "number:1,number:2,string:1,string:a", table.concat(keys, ","))
+
+        local ids = shared.get("ids")
+        assert(ids[1001] == "sword" and ids["1001"] == nil)
+        local c = shared.copy(ids)
+        assert(c[1002] == "shield" and c["1002"] == nil)
+    `)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestLuaSharedDataCircular(t *testing.T) {
+    type node struct {
+        Name string
+        Next *node
+    }
+    n := &node{Name: "a"}
+    n.Next = &node{Name: "b", Next: n}
+
+    m := map[string]interface{}{"v": 1}
+    m["self"] = m
+
+    s := []interface{}{"x", nil}
+    s[1] = s
+
+    L := newTestSharedState(map[string]interface{}{"node": n, "map": m, "slice": s})
+    defer L.Close()
+
+    // circular references are converted to nil
+    err := L.DoString(`
+        local shared = require("shared")
+        local node = shared.get("node")
+        assert(node.Name == "a" and node.Next.Name == "b" and node.Next.Next == nil)
+        local m = shared.get("map")
+        assert(m.v == 1 and m.self == nil)
+        local s = shared.get("slice")
+        assert(#s == 2 and s[1] == "x" and s[2] == nil)
+    `)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
@@ -0,0 +1,203 @@
+package lualib
+
+import (
+    "fmt"
+    "reflect"
+    "strings"
+    "sync"
+
+    "github.com/yuin/gopher-lua"
+)
+
+// field index of struct by Go name, lower Go name, protobuf name and json name
+var structFieldsCache = &sync.Map{}
+
+// copy fields of Lua table to struct pointed by out, e.g. proto message created by protoconv registry
+func LuaTableToStruct(tb *lua.LTable, out interface{}) error {
+    v := reflect.ValueOf(out)
+    if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+        return fmt.Errorf("expected pointer to struct, got %T", out)
+    }
+    return setStructFromLuaTable(tb, v.Elem())
+}
+
+// private
+
+func setStructFromLuaTable(tb *lua.LTable, v reflect.Value) error {
+    fields := structFields(v.Type())
+
+    var err error
+    tb.ForEach(func(key lua.LValue, value lua.LValue) {
+        if err != nil {
+            return
+        }
+        name, ok := key.(lua.LString)
+        if !ok {
+            return
+        }
+        index, ok := fields[string(name)]
+        if !ok {
+            index, ok = fields[strings.ToLower(string(name))]
+        }
+        if !ok {
+            // unknown field is ignored, like unknown field of protobuf
+            return
+        }
+
+        e := setFromLuaValue(value, v.Field(index))
+        if e != nil {
+            err = fmt.Errorf("field '%s': %s", name, e)
+        }
+    })
+    return err
+}
+
+func setFromLuaValue(lv lua.LValue, v reflect.Value) error {
+    if lv == lua.LNil {
+        v.Set(reflect.Zero(v.Type()))
+        return nil
+    }
+
+    if ud, ok := lv.(*lua.LUserData); ok {
+        // value wrapped by luar
+        uv := reflect.ValueOf(ud.Value)
+        switch {
+        case uv.Type().AssignableTo(v.Type()):
+            v.Set(uv)
+        case uv.Kind() == reflect.Ptr && uv.Elem().Type().AssignableTo(v.Type()):
+            v.Set(uv.Elem())
+        default:
+            return fmt.Errorf("can't assign %s to %s", uv.Type(), v.Type())
+        }
+        return nil
+    }
+
+    switch v.Kind() {
+    case reflect.Ptr:
+        p := reflect.New(v.Type().Elem())
+        err := setFromLuaValue(lv, p.Elem())
+        if err != nil {
+            return err
+        }
+        v.Set(p)
+
+    case reflect.Bool:
+        v.SetBool(lua.LVAsBool(lv))
+
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        n, ok := lv.(lua.LNumber)
+        if !ok {
+            return fmt.Errorf("number expected, got %s", lv.Type())
+        }
+        v.SetInt(int64(n))
+
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        n, ok := lv.(lua.LNumber)
+        if !ok {
+            return fmt.Errorf("number expected, got %s", lv.Type())
+        }
+        v.SetUint(uint64(n))
+
+    case reflect.Float32, reflect.Float64:
+        n, ok := lv.(lua.LNumber)
+        if !ok {
+            return fmt.Errorf("number expected, got %s", lv.Type())
+        }
+        v.SetFloat(float64(n))
+
+    case reflect.String:
+        s, ok := lv.(lua.LString)
+        if !ok {
+            return fmt.Errorf("string expected, got %s", lv.Type())
+        }
+        v.SetString(string(s))
+
+    case reflect.Slice:
+        if s, ok := lv.(lua.LString); ok && v.Type().Elem().Kind() == reflect.Uint8 {
+            v.SetBytes([]byte(s))
+            return nil
+        }
+        tb, ok := lv.(*lua.LTable)
+        if !ok {
+            return fmt.Errorf("table expected, got %s", lv.Type())
+        }
+        l := tb.Len()
+        slice := reflect.MakeSlice(v.Type(), l, l)
+        for i := 0; i < l; i++ {
+            err := setFromLuaValue(tb.RawGetInt(i+1), slice.Index(i))
+            if err != nil {
+                return fmt.Errorf("[%d] %s", i+1, err)
+            }
+        }
+        v.Set(slice)
+
+    case reflect.Map:
+        tb, ok := lv.(*lua.LTable)
+        if !ok {
+            return fmt.Errorf("table expected, got %s", lv.Type())
+        }
+        m := reflect.MakeMap(v.Type())
+        var err error
+        tb.ForEach(func(key lua.LValue, value lua.LValue) {
+            if err != nil {
+                return
+            }
+            k := reflect.New(v.Type().Key()).Elem()
+            e := reflect.New(v.Type().Elem()).Elem()
+            if err = setFromLuaValue(key, k); err != nil {
+                return
+            }
+            if err = setFromLuaValue(value, e); err != nil {
+                return
+            }
+            m.SetMapIndex(k, e)
+        })
+        if err != nil {
+            return err
+        }
+        v.Set(m)
+
+    case reflect.Struct:
+        tb, ok := lv.(*lua.LTable)
+        if !ok {
+            return fmt.Errorf("table expected, got %s", lv.Type())
+        }
+        return setStructFromLuaTable(tb, v)
+
+    default:
+        return fmt.Errorf("unsupported type %s", v.Type())
+    }
+
+    return nil
+}
+
+func structFields(t reflect.Type) map[string]int {
+    cached, ok := structFieldsCache.Load(t)
+    if ok {
+        return cached.(map[string]int)
+    }
+
+    fields := make(map[string]int, t.NumField()*3)
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        if f.PkgPath != "" {
+            // unexported
+            continue
+        }
+
+        fields[f.Name] = i
+        fields[strings.ToLower(f.Name)] = i
+        for _, opt := range strings.Split(f.Tag.Get("protobuf"), ",") {
+            if strings.HasPrefix(opt, "name=") {
+                fields[opt[5:]] = i
+            }
+        }
+        json := strings.Split(f.Tag.Get("json"), ",")[0]
+        if json != "" && json != "-" {
+            fields[json] = i
+        }
+    }
+
+    structFieldsCache.Store(t, fields)
+    return fields
+}
@@ -0,0 +1,173 @@
+package lualib
+
+import (
+    "fmt"
+    "reflect"
+
+    "github.com/golang/protobuf/proto"
+    "github.com/yuin/gopher-lua"
+    "layeh.com/gopher-luar"
+)
+
+// convert Lua value to plain Go value: nil, bool, float64, string, []interface{}, map[string]interface{},
+// map[interface{}]interface{} for tables with number keys, proto message of userdata is copied,
+// other userdata, functions, threads and channels are not supported
+func LuaValueToGo(lv lua.LValue) (interface{}, error) {
+    return luaValueToGo(lv, make(map[*lua.LTable]bool))
+}
+
+// convert Go value to Lua value, slices and maps are copied to tables, other values are wrapped by luar
+func GoToLuaValue(L *lua.LState, v interface{}) lua.LValue {
+    switch vv := v.(type) {
+    case nil:
+        return lua.LNil
+    case lua.LValue:
+        return vv
+    case bool:
+        return lua.LBool(vv)
+    case string:
+        return lua.LString(vv)
+    case []byte:
+        return lua.LString(vv)
+    case float64:
+        return lua.LNumber(vv)
+    case int:
+        return lua.LNumber(vv)
+    case error:
+        return lua.LString(vv.Error())
+    }
+
+    rv := reflect.ValueOf(v)
+    switch rv.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return lua.LNumber(rv.Int())
+
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return lua.LNumber(rv.Uint())
+
+    case reflect.Float32, reflect.Float64:
+        return lua.LNumber(rv.Float())
+
+    case reflect.String:
+        return lua.LString(rv.String())
+
+    case reflect.Slice, reflect.Array:
+        if rv.Kind() == reflect.Slice && rv.IsNil() {
+            return lua.LNil
+        }
+        tb := L.CreateTable(rv.Len(), 0)
+        for i := 0; i < rv.Len(); i++ {
+            tb.RawSetInt(i+1, GoToLuaValue(L, rv.Index(i).Interface()))
+        }
+        return tb
+
+    case reflect.Map:
+        if rv.IsNil() {
+            return lua.LNil
+        }
+        tb := L.CreateTable(0, rv.Len())
+        for _, key := range rv.MapKeys() {
+            tb.RawSet(GoToLuaValue(L, key.Interface()), GoToLuaValue(L, rv.MapIndex(key).Interface()))
+        }
+        return tb
+
+    default:
+        return luar.New(L, v)
+    }
+}
+
+// private
+
+func luaValueToGo(lv lua.LValue, visited map[*lua.LTable]bool) (interface{}, error) {
+    switch v := lv.(type) {
+    case *lua.LNilType:
+        return nil, nil
+
+    case lua.LBool:
+        return bool(v), nil
+
+    case lua.LNumber:
+        return float64(v), nil
+
+    case lua.LString:
+        return string(v), nil
+
+    case *lua.LUserData:
+        // value would be shared by Lua states running in different goroutines
+        if pb, ok := v.Value.(proto.Message); ok {
+            return proto.Clone(pb), nil
+        }
+        return nil, fmt.Errorf("userdata of %T is not supported", v.Value)
+
+    case *lua.LTable:
+        if visited[v] {
+            return nil, fmt.Errorf("table has circular reference")
+        }
+        visited[v] = true
+        defer delete(visited, v)
+        return luaTableToGo(v, visited)
+
+    default:
+        return nil, fmt.Errorf("%s value is not supported", lv.Type())
+    }
+}
+
+// table with keys 1..n is converted to slice, table with string keys is converted to map[string]interface{},
+// other tables are converted to map[interface{}]interface{} with string and float64 keys
+func luaTableToGo(tb *lua.LTable, visited map[*lua.LTable]bool) (interface{}, error) {
+    n := tb.MaxN()
+    count := 0
+    tb.ForEach(func(lua.LValue, lua.LValue) {
+        count++
+    })
+
+    if n > 0 && n == count {
+        arr := make([]interface{}, n)
+        for i := 1; i <= n; i++ {
+            v, err := luaValueToGo(tb.RawGetInt(i), visited)
+            if err != nil {
+                return nil, fmt.Errorf("[%d]: %s", i, err)
+            }
+            arr[i-1] = v
+        }
+        return arr, nil
+    }
+
+    m := make(map[interface{}]interface{}, count)
+    numberKey := false
+    var err error
+    tb.ForEach(func(key lua.LValue, value lua.LValue) {
+        if err != nil {
+            return
+        }
+        var k interface{}
+        switch kv := key.(type) {
+        case lua.LString:
+            k = string(kv)
+        case lua.LNumber:
+            k = float64(kv)
+            numberKey = true
+        default:
+            err = fmt.Errorf("%s key is not supported", key.Type())
+            return
+        }
+        v, e := luaValueToGo(value, visited)
+        if e != nil {
+            err = fmt.Errorf("'%s': %s", key.String(), e)
+            return
+        }
+        m[k] = v
+    })
+    if err != nil {
+        return nil, err
+    }
+    if numberKey {
+        return m, nil
+    }
+
+    fields := make(map[string]interface{}, len(m))
+    for k, v := range m {
+        fields[k.(string)] = v
+    }
+    return fields, nil
+}
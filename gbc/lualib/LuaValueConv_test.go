@@ -0,0 +1,99 @@
+package lualib
+
+import (
+    "reflect"
+    "testing"
+
+    "github.com/golang/protobuf/ptypes/wrappers"
+    "github.com/yuin/gopher-lua"
+    "layeh.com/gopher-luar"
+)
+
+func TestLuaValueRoundTrip(t *testing.T) {
+    cases := []struct {
+        value string
+        want  interface{}
+        check string
+    }{
+        {`{1, "a", true}`, []interface{}{1.0, "a", true},
+            `#v == 3 and v[1] == 1 and v[2] == "a" and v[3] == true`},
+        {`{a = 1, b = {c = "d"}}`, map[string]interface{}{"a": 1.0, "b": map[string]interface{}{"c": "d"}},
+            `v.a == 1 and v.b.c == "d"`},
+        {`{1, 2, n = 2}`, map[interface{}]interface{}{1.0: 1.0, 2.0: 2.0, "n": 2.0},
+            `v[1] == 1 and v[2] == 2 and v.n == 2`},
+        {`{[1] = "a", [3] = "c"}`, map[interface{}]interface{}{1.0: "a", 3.0: "c"},
+            `v[1] == "a" and v[2] == nil and v[3] == "c"`},
+        {`{[1] = "number", ["1"] = "string"}`, map[interface{}]interface{}{1.0: "number", "1": "string"},
+            `v[1] == "number" and v["1"] == "string"`},
+        {`{[1.5] = "x"}`, map[interface{}]interface{}{1.5: "x"},
+            `v[1.5] == "x"`},
+    }
+
+    for _, c := range cases {
+        L := lua.NewState()
+        if err := L.DoString("return " + c.value); err != nil {
+            t.Fatal(err)
+        }
+        v, err := LuaValueToGo(L.Get(-1))
+        L.Close()
+        if err != nil {
+            t.Fatalf("%s: %s", c.value, err)
+        }
+        if !reflect.DeepEqual(v, c.want) {
+            t.Fatalf("%s converted to %#v", c.value, v)
+        }
+
+        L = lua.NewState()
+        L.SetGlobal("v", GoToLuaValue(L, v))
+        err = L.DoString("assert(" + c.check + ")")
+        L.Close()
+        if err != nil {
+            t.Fatalf("%s: %s", c.value, err)
+        }
+    }
+}
+
+func TestLuaValueToGoRejected(t *testing.T) {
+    L := lua.NewState()
+    defer L.Close()
+
+    for _, s := range []string{
+        `local t = {}; t.self = t; return t`,
+        `return {f = print}`,
+        `return {[true] = 1}`,
+    } {
+        if err := L.DoString(s); err != nil {
+            t.Fatal(err)
+        }
+        if v, err := LuaValueToGo(L.Get(-1)); err == nil {
+            t.Fatalf("%s converted to %#v", s, v)
+        }
+        L.Pop(1)
+    }
+
+    // userdata would be shared by Lua states
+    if v, err := LuaValueToGo(luar.New(L, &struct{ N int }{})); err == nil {
+        t.Fatalf("userdata converted to %#v", v)
+    }
+}
+
+func TestLuaValueToGoCopyProto(t *testing.T) {
+    L := lua.NewState()
+    defer L.Close()
+
+    pb := &wrappers.StringValue{Value: "a"}
+    tb := L.NewTable()
+    tb.RawSetString("pb", luar.New(L, pb))
+    v, err := LuaValueToGo(tb)
+    if err != nil {
+        t.Fatal(err)
+    }
+    copied, ok := v.(map[string]interface{})["pb"].(*wrappers.StringValue)
+    if !ok || copied == pb || copied.Value != "a" {
+        t.Fatalf("proto converted to %#v", v)
+    }
+    pb.Value = "b"
+    if copied.Value != "a" {
+        t.Fatal("proto shared after converting")
+    }
+}
@@ -0,0 +1,154 @@
+package lualib
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strconv"
+    "time"
+
+    "github.com/dualface/go-cli-colorlog"
+    "github.com/dualface/go-gbc/gbc"
+    "github.com/yuin/gopher-lua"
+)
+
+var ErrWorkerNotFound = errors.New("worker not found")
+
+const (
+    // waiting for reply of worker or actor, used if timeout of call is not set
+    DefaultLuaCallTimeout = 5 * time.Second
+)
+
+// call handler set by worker.onMessage(), return value of handler is reply of call
+const luaWorkerMessageFunc = `
+local fn, msg, from, reply = ...
+local result = fn(msg, from)
+if reply then
+    reply(result)
+end
+`
+
+type (
+    // send reply to caller, only the first reply is accepted, called by any goroutine
+    luaReplyFunc func(value interface{}, err error)
+)
+
+// send message to Lua worker, msg is plain Go value copied to Lua state,
+// handled by function set by worker.onMessage() in its own coroutine
+func (h *ConcurrenceLuaHandler) SendToWorker(workerId string, msg interface{}) error {
+    return h.postToWorker(workerId, msg, nil, nil)
+}
+
+// send message to Lua worker and wait for reply, zero timeout means DefaultLuaCallTimeout
+func (h *ConcurrenceLuaHandler) CallWorker(workerId string, msg interface{}, timeout time.Duration) (interface{}, error) {
+    return h.call(context.Background(), timeout, func(reply luaReplyFunc) error {
+        return h.postToWorker(workerId, msg, nil, reply)
+    })
+}
+
+// send message to actor and wait for return value of OnMessage(), zero timeout means DefaultLuaCallTimeout
+func (h *ConcurrenceLuaHandler) CallActor(id string, msg interface{}, timeout time.Duration) (interface{}, error) {
+    return h.call(context.Background(), timeout, func(reply luaReplyFunc) error {
+        return h.postToActor(id, msg, nil, reply)
+    })
+}
+
+// private
+
+// from is id of sender actor, number of sender worker, or nil
+func (h *ConcurrenceLuaHandler) postToWorker(workerId string, msg interface{}, from interface{}, reply luaReplyFunc) error {
+    h.mutex.RLock()
+    defer h.mutex.RUnlock()
+
+    s := h.pool.scheduler(workerId)
+    if s == nil {
+        return ErrWorkerNotFound
+    }
+    s.post(&luaActorEvent{op: luaWorkerMessage, msg: msg, from: from, reply: reply})
+    return nil
+}
+
+// post message, then wait for reply until timeout or ctx done
+func (h *ConcurrenceLuaHandler) call(ctx context.Context, timeout time.Duration, post func(reply luaReplyFunc) error) (interface{}, error) {
+    if timeout <= 0 {
+        timeout = DefaultLuaCallTimeout
+    }
+
+    ch := make(chan *luaAsyncResult, 1)
+    err := post(func(value interface{}, err error) {
+        select {
+        case ch <- &luaAsyncResult{value: value, err: err}:
+        default:
+        }
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    select {
+    case r := <-ch:
+        return r.value, r.err
+    case <-timer.C:
+        return nil, gbc.ErrRequestTimeout
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+// reply error to caller if event has not been replied
+func (ev *luaActorEvent) fail(err error) {
+    if ev.reply != nil {
+        ev.reply(nil, err)
+    }
+}
+
+// handle message sent to worker in new coroutine
+func (s *luaScheduler) receiveWorkerMessage(L *lua.LState, ev *luaActorEvent) {
+    if s.onMessage == nil {
+        clog.PrintWarn("Lua state %s drop message, handler not set by worker.onMessage()", s.workerId)
+        ev.fail(fmt.Errorf("Lua state %s has no message handler", s.workerId))
+        return
+    }
+
+    t := s.start(L, s.actorFuncs[luaWorkerMessage], []lua.LValue{
+        s.onMessage, GoToLuaValue(L, ev.msg), GoToLuaValue(L, ev.from), s.replyFunc(L, ev),
+    })
+    t.done = func(*lua.LState) {
+        // handler failed
+        ev.fail(fmt.Errorf("Lua state %s failed to handle message", s.workerId))
+    }
+    s.step(L, t, nil)
+}
+
+// returns Lua function which sends copy of its argument to caller, nil if event is not a call
+func (s *luaScheduler) replyFunc(L *lua.LState, ev *luaActorEvent) lua.LValue {
+    if ev.reply == nil {
+        return lua.LNil
+    }
+    return L.NewFunction(func(L *lua.LState) int {
+        v, err := LuaValueToGo(L.Get(1))
+        if err != nil {
+            err = fmt.Errorf("reply of Lua state %s, %s", s.workerId, err)
+        }
+        ev.reply(v, err)
+        return 0
+    })
+}
+
+// id of actor if L is handling event for actor, otherwise number of worker
+func currentSender(L *lua.LState) interface{} {
+    if id := currentActorId(L); id != "" {
+        return id
+    }
+    s := luaSchedulerOf(L)
+    if s == nil {
+        return nil
+    }
+    n, err := strconv.Atoi(s.workerId)
+    if err != nil {
+        return s.workerId
+    }
+    return n
+}
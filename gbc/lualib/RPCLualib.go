@@ -0,0 +1,111 @@
+package lualib
+
+import (
+    "context"
+    "time"
+
+    "github.com/dualface/go-gbc/gbc/impl"
+    "github.com/dualface/go-gbc/gbc/protoconv"
+    "github.com/golang/protobuf/proto"
+    "github.com/yuin/gopher-lua"
+    "layeh.com/gopher-luar"
+)
+
+const (
+    defaultRPCTimeout = 5 * time.Second
+)
+
+func LuaRPCLoader(L *lua.LState) {
+    L.PreloadModule("rpc", func(L *lua.LState) int {
+        rpc := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+            "Dial": rpcDial,
+            "Call": rpcCall,
+            "Send": rpcSend,
+        })
+
+        rpc.RawSetString("Client", luar.NewType(L, &impl.CommandClient{}))
+
+        L.Push(rpc)
+        return 1
+    })
+}
+
+// private
+
+// rpc.Dial(addr [, timeoutSeconds]) returns client, or nil and error
+func rpcDial(L *lua.LState) int {
+    addr := L.CheckString(1)
+    timeout := luaSeconds(L.OptNumber(2, lua.LNumber(defaultRPCTimeout.Seconds())))
+
+    cl, err := impl.DialCommandClient(addr, timeout)
+    if err != nil {
+        L.Push(lua.LNil)
+        L.Push(lua.LString(err.Error()))
+        return 2
+    }
+
+    L.Push(luar.New(L, cl))
+    return 1
+}
+
+// rpc.Call(client, mainCmdId, subCmdId, msg [, timeoutSeconds]) returns reply message, or nil and error,
+// calling coroutine is suspended until reply received when called by message handler
+func rpcCall(L *lua.LState) int {
+    cl, data := checkRPCArgs(L, "Call")
+    mainCmdId := uint16(L.CheckInt(2))
+    subCmdId := uint16(L.CheckInt(3))
+    timeout := luaSeconds(L.OptNumber(5, lua.LNumber(defaultRPCTimeout.Seconds())))
+
+    return Await(L, func(ctx context.Context) (interface{}, error) {
+        // stop waiting if handler is aborted
+        ctx, cancel := context.WithTimeout(ctx, timeout)
+        defer cancel()
+
+        reply, err := cl.CallContext(ctx, mainCmdId, subCmdId, impl.CommandMessageProtobufType, data)
+        if err != nil {
+            return nil, err
+        }
+        return protoconv.UnmarshalCommandMessageToProto(reply)
+    })
+}
+
+// rpc.Send(client, mainCmdId, subCmdId, msg) returns true, or nil and error
+func rpcSend(L *lua.LState) int {
+    cl, data := checkRPCArgs(L, "Send")
+
+    err := cl.Send(uint16(L.CheckInt(2)), uint16(L.CheckInt(3)), impl.CommandMessageProtobufType, data)
+    if err != nil {
+        L.Push(lua.LNil)
+        L.Push(lua.LString(err.Error()))
+        return 2
+    }
+
+    L.Push(lua.LTrue)
+    return 1
+}
+
+func checkRPCArgs(L *lua.LState, name string) (*impl.CommandClient, []byte) {
+    if L.GetTop() < 4 {
+        L.RaiseError("rpc.%s() invalid number of function arguments (4 expected, got %d)", name, L.GetTop())
+    }
+
+    cl, ok := L.CheckUserData(1).Value.(*impl.CommandClient)
+    if !ok {
+        L.ArgError(1, "rpc client expected")
+    }
+
+    pb, ok := L.CheckUserData(4).Value.(proto.Message)
+    if !ok {
+        L.ArgError(4, "proto message expected")
+    }
+
+    data, err := proto.Marshal(pb)
+    if err != nil {
+        L.RaiseError("rpc.%s() marshal message failed, %s", name, err.Error())
+    }
+    return cl, data
+}
+
+func luaSeconds(n lua.LNumber) time.Duration {
+    return time.Duration(float64(n) * float64(time.Second))
+}
@@ -0,0 +1,195 @@
+package lualib
+
+import (
+    "fmt"
+
+    "github.com/yuin/gopher-lua"
+)
+
+const luaSharedTableKey = "gbc.sharedTable"
+
+// shared module for reading data shared by Lua states of ConcurrenceLuaHandler,
+// shared.get(name) and shared.root() read latest version, tables got before replacing keep old version,
+// tables of shared data are read-only userdata, fields are read by t.key, t[index] and #t,
+// iterated by shared.pairs(t) and shared.ipairs(t), copied to plain table by shared.copy(t)
+func luaSharedLoader(p *luaPool) lua.LGFunction {
+    return func(L *lua.LState) int {
+        mt := L.NewTypeMetatable(luaSharedTableKey)
+        L.SetFuncs(mt, map[string]lua.LGFunction{
+            "__index":    sharedTableIndex,
+            "__newindex": sharedTableNewIndex,
+            "__len":      sharedTableLen,
+            "__tostring": sharedTableToString,
+        })
+
+        shared := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+            "get": func(L *lua.LState) int {
+                L.Push(sharedValue(L, p.sharedData().root.get(lua.LString(L.CheckString(1)))))
+                return 1
+            },
+            "root": func(L *lua.LState) int {
+                L.Push(sharedValue(L, p.sharedData().root))
+                return 1
+            },
+            "version": func(L *lua.LState) int {
+                L.Push(lua.LNumber(p.sharedData().version))
+                return 1
+            },
+            "pairs":    sharedPairs,
+            "ipairs":   sharedIPairs,
+            "copy":     sharedCopy,
+            "isShared": sharedIsShared,
+        })
+
+        L.Push(shared)
+        return 1
+    }
+}
+
+// private
+
+// tables are wrapped without copying, other values are converted by GoToLuaValue
+func sharedValue(L *lua.LState, v interface{}) lua.LValue {
+    t, ok := v.(*luaSharedTable)
+    if !ok {
+        return GoToLuaValue(L, v)
+    }
+    ud := L.NewUserData()
+    ud.Value = t
+    L.SetMetatable(ud, L.GetTypeMetatable(luaSharedTableKey))
+    return ud
+}
+
+func checkSharedTable(L *lua.LState, n int) *luaSharedTable {
+    ud, ok := L.Get(n).(*lua.LUserData)
+    if ok {
+        if t, ok := ud.Value.(*luaSharedTable); ok {
+            return t
+        }
+    }
+    L.ArgError(n, "shared table expected")
+    return nil
+}
+
+func sharedTableIndex(L *lua.LState) int {
+    t := checkSharedTable(L, 1)
+    L.Push(sharedValue(L, t.get(L.Get(2))))
+    return 1
+}
+
+func sharedTableNewIndex(L *lua.LState) int {
+    L.RaiseError("shared data is read-only")
+    return 0
+}
+
+func sharedTableLen(L *lua.LState) int {
+    t := checkSharedTable(L, 1)
+    L.Push(lua.LNumber(len(t.items)))
+    return 1
+}
+
+func sharedTableToString(L *lua.LState) int {
+    t := checkSharedTable(L, 1)
+    L.Push(lua.LString(fmt.Sprintf("shared table: %p", t)))
+    return 1
+}
+
+// shared.pairs(t) iterates shared table in order of sorted keys, or plain table like pairs(t)
+func sharedPairs(L *lua.LState) int {
+    if tb, ok := L.Get(1).(*lua.LTable); ok {
+        L.Push(L.GetGlobal("next"))
+        L.Push(tb)
+        L.Push(lua.LNil)
+        return 3
+    }
+
+    t := checkSharedTable(L, 1)
+    n := 0
+    L.Push(L.NewFunction(func(L *lua.LState) int {
+        key, v, ok := t.at(n)
+        if !ok {
+            L.Push(lua.LNil)
+            return 1
+        }
+        n++
+        L.Push(key)
+        L.Push(sharedValue(L, v))
+        return 2
+    }))
+    return 1
+}
+
+// shared.ipairs(t) iterates items of shared table, or plain table like ipairs(t)
+func sharedIPairs(L *lua.LState) int {
+    if tb, ok := L.Get(1).(*lua.LTable); ok {
+        i := 0
+        L.Push(L.NewFunction(func(L *lua.LState) int {
+            i++
+            v := tb.RawGetInt(i)
+            if v == lua.LNil {
+                L.Push(lua.LNil)
+                return 1
+            }
+            L.Push(lua.LNumber(i))
+            L.Push(v)
+            return 2
+        }))
+        return 1
+    }
+
+    t := checkSharedTable(L, 1)
+    i := 0
+    L.Push(L.NewFunction(func(L *lua.LState) int {
+        if i >= len(t.items) {
+            L.Push(lua.LNil)
+            return 1
+        }
+        i++
+        L.Push(lua.LNumber(i))
+        L.Push(sharedValue(L, t.items[i-1]))
+        return 2
+    }))
+    return 1
+}
+
+// shared.copy(v) returns plain table copied from shared table, other values are returned as is
+func sharedCopy(L *lua.LState) int {
+    ud, ok := L.Get(1).(*lua.LUserData)
+    if !ok {
+        L.Push(L.Get(1))
+        return 1
+    }
+    t, ok := ud.Value.(*luaSharedTable)
+    if !ok {
+        L.Push(ud)
+        return 1
+    }
+    L.Push(copySharedTable(L, t))
+    return 1
+}
+
+// shared.isShared(v) returns true if v is shared table
+func sharedIsShared(L *lua.LState) int {
+    ud, ok := L.Get(1).(*lua.LUserData)
+    if ok {
+        _, ok = ud.Value.(*luaSharedTable)
+    }
+    L.Push(lua.LBool(ok))
+    return 1
+}
+
+func copySharedTable(L *lua.LState, t *luaSharedTable) *lua.LTable {
+    tb := L.CreateTable(len(t.items), len(t.keys))
+    for n := 0; ; n++ {
+        key, v, ok := t.at(n)
+        if !ok {
+            break
+        }
+        if st, ok := v.(*luaSharedTable); ok {
+            tb.RawSet(key, copySharedTable(L, st))
+        } else {
+            tb.RawSet(key, GoToLuaValue(L, v))
+        }
+    }
+    return tb
+}
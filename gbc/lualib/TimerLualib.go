@@ -0,0 +1,240 @@
+package lualib
+
+import (
+    "time"
+
+    "github.com/yuin/gopher-lua"
+)
+
+const (
+    luaTimeLayout  = "2006-01-02 15:04:05"
+    luaDailyLayout = "15:04:05"
+)
+
+type (
+    // timer of Lua worker, fired by Go timer and delivered through RESUME_CHAN of the worker,
+    // callback runs in new coroutine of the worker
+    luaTimer struct {
+        id    int
+        fn    *lua.LFunction
+        owner lua.LValue
+        once  bool
+        next  func(prev time.Time) time.Time // returns next fire time after prev, zero means no more
+        stop  chan struct{}
+    }
+)
+
+// timer module for Lua workers of ConcurrenceLuaHandler, all timers are stopped when Lua state closed,
+// callbacks are called as fn(timerId), owner is optional, timers of owner can be cancelled by cancelAll(owner)
+func luaTimerLoader(L *lua.LState) int {
+    timer := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+        "after":     timerAfter,
+        "every":     timerEvery,
+        "at":        timerAt,
+        "daily":     timerDaily,
+        "cron":      timerCron,
+        "cancel":    timerCancel,
+        "cancelAll": timerCancelAll,
+        "count":     timerCount,
+    })
+
+    L.Push(timer)
+    return 1
+}
+
+// private
+
+// timer.after(seconds, fn [, owner]) returns timer id
+func timerAfter(L *lua.LState) int {
+    d := luaSeconds(L.CheckNumber(1))
+    fired := false
+    return addLuaTimer(L, "after", true, func(prev time.Time) time.Time {
+        if fired {
+            return time.Time{}
+        }
+        fired = true
+        return prev.Add(d)
+    })
+}
+
+// timer.every(seconds, fn [, owner]) returns timer id, ticks missed when worker is busy are skipped
+func timerEvery(L *lua.LState) int {
+    d := luaSeconds(L.CheckNumber(1))
+    if d <= 0 {
+        L.ArgError(1, "interval must be greater than 0")
+    }
+    return addLuaTimer(L, "every", false, func(prev time.Time) time.Time {
+        return prev.Add(d)
+    })
+}
+
+// timer.at(unixSeconds | "2006-01-02 15:04:05", fn [, owner]) returns timer id, time string is local time
+func timerAt(L *lua.LState) int {
+    var at time.Time
+    switch v := L.Get(1).(type) {
+    case lua.LNumber:
+        at = time.Unix(0, int64(float64(v)*float64(time.Second)))
+    case lua.LString:
+        t, err := time.ParseInLocation(luaTimeLayout, string(v), time.Local)
+        if err != nil {
+            L.ArgError(1, err.Error())
+        }
+        at = t
+    default:
+        L.TypeError(1, lua.LTNumber)
+    }
+
+    fired := false
+    return addLuaTimer(L, "at", true, func(time.Time) time.Time {
+        if fired {
+            return time.Time{}
+        }
+        fired = true
+        return at
+    })
+}
+
+// timer.daily("15:04[:05]", fn [, owner]) returns timer id, fired at the local time every day
+func timerDaily(L *lua.LState) int {
+    spec := L.CheckString(1)
+    if len(spec) == len("15:04") {
+        spec += ":00"
+    }
+    clock, err := time.Parse(luaDailyLayout, spec)
+    if err != nil {
+        L.ArgError(1, err.Error())
+    }
+
+    return addLuaTimer(L, "daily", false, func(prev time.Time) time.Time {
+        y, m, d := prev.Date()
+        at := time.Date(y, m, d, clock.Hour(), clock.Minute(), clock.Second(), 0, prev.Location())
+        if !at.After(prev) {
+            at = at.AddDate(0, 0, 1)
+        }
+        return at
+    })
+}
+
+// timer.cron("minute hour day month weekday", fn [, owner]) returns timer id, fired at local time
+func timerCron(L *lua.LState) int {
+    schedule, err := parseCronSchedule(L.CheckString(1))
+    if err != nil {
+        L.ArgError(1, err.Error())
+    }
+    return addLuaTimer(L, "cron", false, schedule.Next)
+}
+
+// timer.cancel(id) returns true if timer was active
+func timerCancel(L *lua.LState) int {
+    s := checkLuaScheduler(L, "cancel")
+    id := L.CheckInt(1)
+
+    t, ok := s.timers[id]
+    if ok {
+        s.stopTimer(t)
+    }
+    L.Push(lua.LBool(ok))
+    return 1
+}
+
+// timer.cancelAll(owner) returns number of cancelled timers
+func timerCancelAll(L *lua.LState) int {
+    s := checkLuaScheduler(L, "cancelAll")
+    owner := L.CheckAny(1)
+
+    L.Push(lua.LNumber(s.cancelTimers(owner)))
+    return 1
+}
+
+// timer.count([owner]) returns number of active timers
+func timerCount(L *lua.LState) int {
+    s := checkLuaScheduler(L, "count")
+    owner := L.Get(1)
+
+    n := 0
+    for _, t := range s.timers {
+        if owner == lua.LNil || t.owner == owner {
+            n++
+        }
+    }
+    L.Push(lua.LNumber(n))
+    return 1
+}
+
+func checkLuaScheduler(L *lua.LState, name string) *luaScheduler {
+    s := luaSchedulerOf(L)
+    if s == nil {
+        L.RaiseError("timer.%s() must be called in Lua worker", name)
+    }
+    return s
+}
+
+func addLuaTimer(L *lua.LState, name string, once bool, next func(prev time.Time) time.Time) int {
+    s := checkLuaScheduler(L, name)
+
+    s.lastTimer++
+    t := &luaTimer{
+        id:    s.lastTimer,
+        fn:    L.CheckFunction(2),
+        owner: L.Get(3),
+        once:  once,
+        next:  next,
+        stop:  make(chan struct{}),
+    }
+    s.timers[t.id] = t
+    go t.run(s)
+
+    L.Push(lua.LNumber(t.id))
+    return 1
+}
+
+// returns number of cancelled timers
+func (s *luaScheduler) cancelTimers(owner lua.LValue) int {
+    n := 0
+    for _, t := range s.timers {
+        if t.owner == owner {
+            s.stopTimer(t)
+            n++
+        }
+    }
+    return n
+}
+
+func (s *luaScheduler) stopTimer(t *luaTimer) {
+    delete(s.timers, t.id)
+    close(t.stop)
+}
+
+func (t *luaTimer) run(s *luaScheduler) {
+    prev := time.Now()
+    for {
+        at := t.next(prev)
+        if at.IsZero() {
+            return
+        }
+        if now := time.Now(); !t.once && at.Before(now) {
+            // worker is busy, skip missed
+            at = t.next(now)
+        }
+
+        timer := time.NewTimer(time.Until(at))
+        select {
+        case <-timer.C:
+        case <-t.stop:
+            timer.Stop()
+            return
+        case <-s.done:
+            timer.Stop()
+            return
+        }
+
+        select {
+        case s.resumeChan <- &lua.LUserData{Value: t}:
+        case <-t.stop:
+            return
+        case <-s.done:
+            return
+        }
+        prev = at
+    }
+}
@@ -0,0 +1,98 @@
+package lualib
+
+import (
+    "context"
+    "strconv"
+
+    "github.com/yuin/gopher-lua"
+)
+
+// worker module for messaging between Lua workers of ConcurrenceLuaHandler,
+// target of message is number of worker, or id of actor if it is string,
+// messages and replies are copied by LuaValueToGo, so only plain tables and proto messages can be sent
+func luaWorkerLoader(h *ConcurrenceLuaHandler) lua.LGFunction {
+    return func(L *lua.LState) int {
+        worker := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+            "id": workerCurrentId,
+            "count": func(L *lua.LState) int {
+                L.Push(lua.LNumber(h.concurrence))
+                return 1
+            },
+            "onMessage": workerOnMessage,
+            "send": func(L *lua.LState) int {
+                return workerSend(L, h)
+            },
+            "call": func(L *lua.LState) int {
+                return workerCall(L, h)
+            },
+        })
+
+        L.Push(worker)
+        return 1
+    }
+}
+
+// private
+
+// worker.id() returns number of calling worker
+func workerCurrentId(L *lua.LState) int {
+    s := luaSchedulerOf(L)
+    if s == nil {
+        L.RaiseError("worker.id() must be called in Lua worker")
+    }
+    n, _ := strconv.Atoi(s.workerId)
+    L.Push(lua.LNumber(n))
+    return 1
+}
+
+// worker.onMessage(fn), fn(msg, from) handles message sent to calling worker in its own coroutine,
+// from is number of sender worker, id of sender actor, or nil if sent by Go, return value is reply of call
+func workerOnMessage(L *lua.LState) int {
+    fn := L.CheckFunction(1)
+    s := luaSchedulerOf(L)
+    if s == nil {
+        L.RaiseError("worker.onMessage() must be called in Lua worker")
+    }
+    s.onMessage = fn
+    return 0
+}
+
+// worker.send(to, msg) returns true, or nil and error if target not exists
+func workerSend(L *lua.LState, h *ConcurrenceLuaHandler) int {
+    post := checkMessageTarget(L, h)
+    return pushLuaResult(L, post(nil))
+}
+
+// worker.call(to, msg [, timeoutSeconds]) returns reply, or nil and error,
+// calling coroutine is suspended until reply received
+func workerCall(L *lua.LState, h *ConcurrenceLuaHandler) int {
+    post := checkMessageTarget(L, h)
+    timeout := luaSeconds(L.OptNumber(3, 0))
+    return Await(L, func(ctx context.Context) (interface{}, error) {
+        return h.call(ctx, timeout, post)
+    })
+}
+
+// returns function posting copy of msg to target
+func checkMessageTarget(L *lua.LState, h *ConcurrenceLuaHandler) func(reply luaReplyFunc) error {
+    msg, err := LuaValueToGo(L.Get(2))
+    if err != nil {
+        L.ArgError(2, err.Error())
+    }
+    from := currentSender(L)
+
+    switch to := L.Get(1).(type) {
+    case lua.LNumber:
+        workerId := strconv.Itoa(int(to))
+        return func(reply luaReplyFunc) error {
+            return h.postToWorker(workerId, msg, from, reply)
+        }
+    case lua.LString:
+        return func(reply luaReplyFunc) error {
+            return h.postToActor(string(to), msg, from, reply)
+        }
+    default:
+        L.ArgError(1, "number of worker or id of actor expected")
+        return nil
+    }
+}
@@ -0,0 +1,76 @@
+local actor = require("actor")
+local timer = require("timer")
+local workers = require("worker")
+
+--- @class gbc.Actor
+local Actor = gbc.Class("Actor")
+gbc.Actor = Actor
+
+-- register actor class, same kind must be registered in all Lua workers
+function Actor.Register(kind, cls)
+    actor.register(kind, cls)
+end
+
+-- spawn actor on the Lua worker chosen by id, args is copied
+function Actor.Spawn(kind, id, args)
+    return actor.spawn(kind, id, args)
+end
+
+function Actor:Constructor(id, args)
+    self.id = id
+    self.outputChan = WORKER.OUTPUT_CHAN
+end
+
+function Actor:Id()
+    return self.id
+end
+
+-- messages in mailbox are handled one by one, msg is copied table,
+-- or table of inbound message like MessageHandler:ReceiveProtoMessage() if from is nil,
+-- from is id of actor or number of worker, return value is reply of Call()
+function Actor:OnMessage(msg, from)
+end
+
+-- called before actor stopped, timers of actor are cancelled after that
+function Actor:OnStop()
+end
+
+-- returns table of actor state, saved when actor stopped or moved to new Lua worker after reloading
+function Actor:Snapshot()
+    return nil
+end
+
+-- restore state from snapshot after Constructor()
+function Actor:Restore(snapshot)
+end
+
+-- send msg to another actor, or to worker if to is number, msg is copied
+function Actor:Send(to, msg)
+    return workers.send(to, msg)
+end
+
+-- send msg to actor or worker and wait for reply, next message in mailbox waits until reply received
+function Actor:Call(to, msg, timeoutSeconds)
+    return workers.call(to, msg, timeoutSeconds)
+end
+
+function Actor:Stop()
+    return actor.stop(self.id)
+end
+
+-- call fn(self, timerId) after seconds, returns timer id, cancelled when actor stopped
+function Actor:After(seconds, fn)
+    return timer.after(seconds, function(id) fn(self, id) end, self)
+end
+
+-- call fn(self, timerId) every seconds, returns timer id, cancelled when actor stopped
+function Actor:Every(seconds, fn)
+    return timer.every(seconds, function(id) fn(self, id) end, self)
+end
+
+function Actor:CancelTimer(id)
+    return timer.cancel(id)
+end
+
+Actor.SendMessage = gbc.MessageHandler.SendMessage
+Actor.Reply = gbc.MessageHandler.Reply
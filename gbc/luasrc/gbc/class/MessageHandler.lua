@@ -1,4 +1,6 @@
 local proto = require("proto")
+local timer = require("timer")
+local workers = require("worker")
 
 --- @class gbc.MessageHandler
 local MessageHandler = gbc.Class("MessageHandler")
@@ -20,27 +22,116 @@ function MessageHandler:StartLoop()
 
     local inputChan = self.inputChan
     local exit = false
+    -- each message is handled in its own coroutine with timeout and instruction budget,
+    -- coroutine suspended by async IO is resumed by events from RESUME_CHAN, errors are reported by host
+    local worker = type(WORKER) == "table" and WORKER.HANDLE and WORKER
+    local resumeChan = worker and worker.RESUME_CHAN
+    if worker then
+        workers.onMessage(function(msg, from)
+            return self:OnWorkerMessage(msg, from)
+        end)
+    end
+
+    local onInput = function(ok, msg)
+        if not ok then
+            -- channel is closed, finish suspended messages before exit
+            inputChan = nil
+            return
+        end
+        if worker then
+            if worker.HANDLE(self.ReceiveProtoMessage, self, msg) then
+                self:SetIdle()
+            end
+        else
+            self:ReceiveProtoMessage(msg)
+            self:SetIdle()
+        end
+    end
+
+    local onResume = function(ok, ev)
+        if ok and worker.RESUME(ev) and inputChan then
+            -- worker was full
+            self:SetIdle()
+        end
+    end
 
     gbc.Printf("- GBCHandler %s loop start", self.id)
 
     while not exit do
-        channel.select({ "|<-", inputChan, function(ok, msg)
-            if not ok then
-                -- channel is closed
-                exit = true
-            else
-                self:ReceiveProtoMessage(msg)
-                self:SetIdle()
-            end
-        end })
+        if inputChan and resumeChan then
+            channel.select({ "|<-", inputChan, onInput }, { "|<-", resumeChan, onResume })
+        elseif inputChan then
+            channel.select({ "|<-", inputChan, onInput })
+        elseif worker and worker.PENDING() > 0 then
+            channel.select({ "|<-", resumeChan, onResume })
+        else
+            exit = true
+        end
     end
 
+    self:Destroy()
     gbc.Printf("- GBCHandler %s loop end", self.id)
 end
 
+-- cancel all timers owned by handler
+function MessageHandler:Destroy()
+    timer.cancelAll(self)
+end
+
+-- call fn(self, timerId) after seconds, returns timer id
+function MessageHandler:After(seconds, fn)
+    return timer.after(seconds, function(id) fn(self, id) end, self)
+end
+
+-- call fn(self, timerId) every seconds, returns timer id
+function MessageHandler:Every(seconds, fn)
+    return timer.every(seconds, function(id) fn(self, id) end, self)
+end
+
+-- call fn(self, timerId) at "15:04[:05]" of local time every day, returns timer id
+function MessageHandler:Daily(clock, fn)
+    return timer.daily(clock, function(id) fn(self, id) end, self)
+end
+
+-- call fn(self, timerId) on cron schedule "minute hour day month weekday", returns timer id
+function MessageHandler:Cron(spec, fn)
+    return timer.cron(spec, function(id) fn(self, id) end, self)
+end
+
+function MessageHandler:CancelTimer(id)
+    return timer.cancel(id)
+end
+
 function MessageHandler:ReceiveProtoMessage(msg)
     gbc.Printf("- GBCHandler %s receive message: %s", self.id, tostring(msg))
 end
 
-function MessageHandler:SendMessage(msg)
+-- handle msg sent by another worker or actor, from is number of worker or id of actor,
+-- return value is reply of Call()
+function MessageHandler:OnWorkerMessage(msg, from)
+    gbc.Printf("- GBCHandler %s receive message from %s", self.id, tostring(from))
+end
+
+-- send msg to worker if to is number, or to actor if to is string, msg is copied
+function MessageHandler:Send(to, msg)
+    return workers.send(to, msg)
+end
+
+-- send msg to worker or actor and wait for reply, returns reply, or nil and error
+function MessageHandler:Call(to, msg, timeoutSeconds)
+    return workers.call(to, msg, timeoutSeconds)
+end
+
+-- cmd is { mainCmdId, subCmdId } or { mainCmdId = 1, subCmdId = 2 },
+-- can be nil if msg is proto message registered to protoconv,
+-- msg is proto message or table of message fields, returns true, or nil and error if msg can't be encoded
+function MessageHandler:SendMessage(connId, cmd, msg, requestId)
+    -- encoded by Go before sending, output goroutine must not read Lua values
+    return WORKER.SEND(connId, cmd, msg, requestId)
+end
+
+-- reply to the received message, carry its request id, cmd is same as request if not set
+function MessageHandler:Reply(request, msg, cmd)
+    cmd = cmd or { request.mainCmdId, request.subCmdId }
+    return self:SendMessage(request.connId, cmd, msg, request.requestId)
 end
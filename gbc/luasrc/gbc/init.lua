@@ -70,3 +70,5 @@ require("gbc.class")
 require("gbc.debug")
 require("gbc.ctype")
 require("gbc.class.MessageHandler")
+
+require("gbc.class.Actor")
\ No newline at end of file
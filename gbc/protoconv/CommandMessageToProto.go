@@ -2,6 +2,8 @@ package protoconv
 
 import (
     "fmt"
+    "reflect"
+    "sync"
 
     "github.com/dualface/go-gbc/gbc/impl"
     "github.com/golang/protobuf/proto"
@@ -18,22 +20,53 @@ type (
 
 var registry = map[int]ProtoMessageCreator{}
 
+// proto message type to command, first registered command wins
+var reverseRegistry = map[reflect.Type]int{}
+
+// handlers may be registered after server started
+var registryMutex = &sync.RWMutex{}
+
 func RegisterCommandMessageToProto(mainCmdId int, subCmdId int, c ProtoMessageCreator) error {
     key := genKey(mainCmdId, subCmdId)
 
+    registryMutex.Lock()
+    defer registryMutex.Unlock()
+
     _, ok := registry[key]
     if ok {
         return fmt.Errorf("command %d:%d already exits", mainCmdId, subCmdId)
     }
 
     registry[key] = c
+    t := reflect.TypeOf(c())
+    if _, ok := reverseRegistry[t]; !ok {
+        reverseRegistry[t] = key
+    }
     return nil
 }
 
-func UnmarshalCommandMessageToProto(msg *impl.CommandMessage) (proto.Message, error) {
-    key := genKey(msg.MainCmdId(), msg.SubCmdId())
+// find command registered for type of pb
+func LookupProtoToCommandMessage(pb proto.Message) (mainCmdId int, subCmdId int, ok bool) {
+    registryMutex.RLock()
+    defer registryMutex.RUnlock()
 
-    c, ok := registry[key]
+    key, ok := reverseRegistry[reflect.TypeOf(pb)]
+    if !ok {
+        return 0, 0, false
+    }
+    return key >> 16 & mainCmdIdMask, key & subCmdIdMask, true
+}
+
+func LookupCommandMessageToProto(mainCmdId int, subCmdId int) (ProtoMessageCreator, bool) {
+    registryMutex.RLock()
+    defer registryMutex.RUnlock()
+
+    c, ok := registry[genKey(mainCmdId, subCmdId)]
+    return c, ok
+}
+
+func UnmarshalCommandMessageToProto(msg *impl.CommandMessage) (proto.Message, error) {
+    c, ok := LookupCommandMessageToProto(msg.MainCmdId(), msg.SubCmdId())
     if !ok {
         return nil, fmt.Errorf("not found registered command %d:%d", msg.MainCmdId(), msg.SubCmdId())
     }
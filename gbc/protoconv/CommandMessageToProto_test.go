@@ -0,0 +1,60 @@
+package protoconv
+
+import (
+    "sync"
+    "testing"
+
+    "github.com/dualface/go-gbc/gbc/impl"
+    "github.com/golang/protobuf/proto"
+    "github.com/golang/protobuf/ptypes/wrappers"
+)
+
+// run with go test -race
+
+func TestRegisterCommandMessageToProto(t *testing.T) {
+    newString := func() proto.Message { return &wrappers.StringValue{} }
+    b, _ := proto.Marshal(&wrappers.StringValue{Value: "hello"})
+
+    // registry is global, test may run more than once
+    want := 1
+    if _, ok := LookupCommandMessageToProto(100, 1); ok {
+        want = 0
+    }
+
+    var wg sync.WaitGroup
+    var mutex sync.Mutex
+    registered := 0
+    for i := 0; i < 8; i++ {
+        wg.Add(2)
+        go func(sub int) {
+            defer wg.Done()
+            if RegisterCommandMessageToProto(100, 1, newString) == nil {
+                mutex.Lock()
+                registered++
+                mutex.Unlock()
+            }
+            RegisterCommandMessageToProto(100, sub+2, newString)
+        }(i)
+        go func() {
+            defer wg.Done()
+            m := impl.NewCommandMessageFromData(100, 1, impl.CommandMessageProtobufType, b)
+            pb, err := UnmarshalCommandMessageToProto(m)
+            if err == nil && pb.(*wrappers.StringValue).Value != "hello" {
+                t.Errorf("unmarshaled %v", pb)
+            }
+            LookupProtoToCommandMessage(&wrappers.StringValue{})
+        }()
+    }
+    wg.Wait()
+
+    if registered != want {
+        t.Fatalf("command registered %d times", registered)
+    }
+    mainCmdId, subCmdId, ok := LookupProtoToCommandMessage(&wrappers.StringValue{})
+    if !ok || mainCmdId != 100 || subCmdId < 1 {
+        t.Fatalf("lookup type got %d:%d", mainCmdId, subCmdId)
+    }
+    if _, ok := LookupCommandMessageToProto(100, 9); !ok {
+        t.Fatal("command 100:9 not registered")
+    }
+}
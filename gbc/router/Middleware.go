@@ -0,0 +1,159 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package router
+
+import (
+    "fmt"
+    "runtime/debug"
+    "sync"
+    "time"
+
+    "github.com/dualface/go-cli-colorlog"
+    "github.com/dualface/go-gbc/gbc"
+    "github.com/dualface/go-gbc/gbc/impl"
+)
+
+type (
+    // returns true if connection of message is allowed to send it
+    AuthFunc func(m *impl.CommandMessage) bool
+)
+
+// print command, time cost and error of each message
+func Logger() Middleware {
+    return func(next HandlerFunc) HandlerFunc {
+        return func(m *impl.CommandMessage) error {
+            start := time.Now()
+            err := next(m)
+            if err != nil {
+                clog.PrintWarn("command %d:%d failed in %s, %s", m.MainCmdId(), m.SubCmdId(), time.Since(start), err)
+            } else {
+                clog.PrintInfo("command %d:%d done in %s", m.MainCmdId(), m.SubCmdId(), time.Since(start))
+            }
+            return err
+        }
+    }
+}
+
+// convert panic of handler to error, so one bad message doesn't crash server
+func Recover() Middleware {
+    return func(next HandlerFunc) HandlerFunc {
+        return func(m *impl.CommandMessage) (err error) {
+            defer func() {
+                if e := recover(); e != nil {
+                    clog.PrintError("command %d:%d panic: %v\n%s", m.MainCmdId(), m.SubCmdId(), e, debug.Stack())
+                    err = fmt.Errorf("command %d:%d panic: %v", m.MainCmdId(), m.SubCmdId(), e)
+                }
+            }()
+            return next(m)
+        }
+    }
+}
+
+// reject message with gbc.ErrUnauthorized if check fails, except specified commands (e.g. login),
+// use impl.AnySubCmdId to except all sub commands of main command
+func Auth(check AuthFunc, except ...impl.CommandId) Middleware {
+    public := make(map[impl.CommandId]bool, len(except))
+    for _, id := range except {
+        public[id] = true
+    }
+
+    return func(next HandlerFunc) HandlerFunc {
+        return func(m *impl.CommandMessage) error {
+            if public[impl.CommandId{MainCmdId: m.MainCmdId(), SubCmdId: m.SubCmdId()}] ||
+                public[impl.CommandId{MainCmdId: m.MainCmdId(), SubCmdId: impl.AnySubCmdId}] ||
+                check(m) {
+                return next(m)
+            }
+            return gbc.ErrUnauthorized
+        }
+    }
+}
+
+// returns true if session of connection has the key, e.g. user id set after login
+func SessionHas(key string) AuthFunc {
+    return func(m *impl.CommandMessage) bool {
+        c := m.Connection()
+        if c == nil || c.Session() == nil {
+            return false
+        }
+        _, ok := c.Session().Get(key)
+        return ok
+    }
+}
+
+// limit messages of each connection before handling, messages without connection are not limited
+func RateLimit(policy *impl.RateLimitPolicy) Middleware {
+    limiters := make(map[uint64]*impl.RateLimiter)
+    mutex := &sync.Mutex{}
+
+    return func(next HandlerFunc) HandlerFunc {
+        return func(m *impl.CommandMessage) error {
+            c := m.Connection()
+            if c == nil {
+                return next(m)
+            }
+
+            mutex.Lock()
+            l, ok := limiters[c.Id()]
+            if !ok {
+                l = impl.NewRateLimiter(policy)
+                limiters[c.Id()] = l
+                go func() {
+                    // forget connection after closed
+                    <-c.Done()
+                    mutex.Lock()
+                    delete(limiters, c.Id())
+                    mutex.Unlock()
+                }()
+            }
+            wait, v := l.Allow(m)
+            mutex.Unlock()
+
+            if v != nil && policy.OnViolation != nil {
+                // callback may close connection
+                go policy.OnViolation(c, *v)
+            }
+            if wait > 0 {
+                select {
+                case <-time.After(wait):
+                case <-c.Done():
+                    return gbc.ErrConnectionClosed
+                }
+            }
+            if v == nil {
+                return next(m)
+            }
+
+            switch v.Action {
+            case impl.RateLimitActionDrop:
+                return v.Err
+            case impl.RateLimitActionDisconnect:
+                // Close() waits for the message being forwarded
+                go c.Close()
+                return v.Err
+            default:
+                return next(m)
+            }
+        }
+    }
+}
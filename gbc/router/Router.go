@@ -0,0 +1,184 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package router
+
+import (
+    "fmt"
+    "reflect"
+    "sync"
+
+    "github.com/dualface/go-gbc/gbc"
+    "github.com/dualface/go-gbc/gbc/impl"
+    "github.com/dualface/go-gbc/gbc/protoconv"
+    "github.com/golang/protobuf/proto"
+)
+
+type (
+    HandlerFunc func(m *impl.CommandMessage) error
+
+    // wrap handler, e.g. logging, auth, rate limit, panic recovery
+    Middleware func(next HandlerFunc) HandlerFunc
+
+    // dispatch CommandMessage to handler by mainCmdId and subCmdId
+    Router struct {
+        handlers    map[impl.CommandId]HandlerFunc
+        fallback    HandlerFunc
+        middlewares []Middleware
+        chain       HandlerFunc
+        mutex       *sync.RWMutex
+    }
+)
+
+var (
+    commandMessageType = reflect.TypeOf((*impl.CommandMessage)(nil))
+    protoMessageType   = reflect.TypeOf((*proto.Message)(nil)).Elem()
+    errorType          = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+func NewRouter() *Router {
+    r := &Router{
+        handlers: make(map[impl.CommandId]HandlerFunc),
+        mutex:    &sync.RWMutex{},
+    }
+    r.chain = r.dispatch
+    return r
+}
+
+// interface RawMessageReceiver
+
+func (r *Router) ReceiveRawMessage(m gbc.RawMessage) error {
+    return r.Route(m)
+}
+
+// public
+
+// register handler for command, use impl.AnySubCmdId to handle all sub commands of main command
+func (r *Router) Handle(mainCmdId int, subCmdId int, h HandlerFunc) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    id := impl.CommandId{MainCmdId: mainCmdId, SubCmdId: subCmdId}
+    _, ok := r.handlers[id]
+    if ok {
+        return fmt.Errorf("handler of command %d:%d already exists", mainCmdId, subCmdId)
+    }
+    r.handlers[id] = h
+    return nil
+}
+
+// register handler for all sub commands of main command
+func (r *Router) HandleMain(mainCmdId int, h HandlerFunc) error {
+    return r.Handle(mainCmdId, impl.AnySubCmdId, h)
+}
+
+// register typed handler: func(m *impl.CommandMessage, pb *pb.SomeMessage) error,
+// message data is unmarshaled with protoconv registry, pb type is registered to protoconv if not exists
+func (r *Router) HandleProto(mainCmdId int, subCmdId int, handler interface{}) error {
+    f := reflect.ValueOf(handler)
+    t := f.Type()
+    if t.Kind() != reflect.Func || t.NumIn() != 2 || t.NumOut() != 1 ||
+        t.In(0) != commandMessageType || !t.In(1).Implements(protoMessageType) || t.In(1).Kind() != reflect.Ptr ||
+        t.Out(0) != errorType {
+        return fmt.Errorf("handler of command %d:%d must be func(*impl.CommandMessage, proto.Message) error, got %s", mainCmdId, subCmdId, t)
+    }
+
+    pbType := t.In(1)
+    if subCmdId != impl.AnySubCmdId {
+        _, ok := protoconv.LookupCommandMessageToProto(mainCmdId, subCmdId)
+        if !ok {
+            // fails only if registered by others in the meantime, type is checked when handling
+            protoconv.RegisterCommandMessageToProto(mainCmdId, subCmdId, func() proto.Message {
+                return reflect.New(pbType.Elem()).Interface().(proto.Message)
+            })
+        }
+    }
+
+    return r.Handle(mainCmdId, subCmdId, func(m *impl.CommandMessage) error {
+        pb, err := protoconv.UnmarshalCommandMessageToProto(m)
+        if err != nil {
+            return err
+        }
+
+        v := reflect.ValueOf(pb)
+        if v.Type() != pbType {
+            return fmt.Errorf("command %d:%d registered as %s, handler wants %s", m.MainCmdId(), m.SubCmdId(), v.Type(), pbType)
+        }
+
+        out := f.Call([]reflect.Value{reflect.ValueOf(m), v})
+        err, _ = out[0].Interface().(error)
+        return err
+    })
+}
+
+// set handler for unregistered commands
+func (r *Router) Fallback(h HandlerFunc) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.fallback = h
+}
+
+// append middlewares, first one is the outermost
+func (r *Router) Use(middlewares ...Middleware) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    r.middlewares = append(r.middlewares, middlewares...)
+    chain := r.dispatch
+    for i := len(r.middlewares) - 1; i >= 0; i-- {
+        chain = r.middlewares[i](chain)
+    }
+    r.chain = chain
+}
+
+// route message to handler, can be used as gbc.OnRawMessageFunc
+func (r *Router) Route(m gbc.RawMessage) error {
+    cm, ok := m.(*impl.CommandMessage)
+    if !ok {
+        return fmt.Errorf("router can't handle message %T", m)
+    }
+
+    r.mutex.RLock()
+    chain := r.chain
+    r.mutex.RUnlock()
+
+    return chain(cm)
+}
+
+// private
+
+func (r *Router) dispatch(m *impl.CommandMessage) error {
+    r.mutex.RLock()
+    h, ok := r.handlers[impl.CommandId{MainCmdId: m.MainCmdId(), SubCmdId: m.SubCmdId()}]
+    if !ok {
+        h, ok = r.handlers[impl.CommandId{MainCmdId: m.MainCmdId(), SubCmdId: impl.AnySubCmdId}]
+    }
+    if !ok {
+        h, ok = r.fallback, r.fallback != nil
+    }
+    r.mutex.RUnlock()
+
+    if !ok {
+        return fmt.Errorf("not found handler for command %d:%d", m.MainCmdId(), m.SubCmdId())
+    }
+    return h(m)
+}
@@ -0,0 +1,119 @@
+// MIT License
+//
+// Copyright (c) 2018 dualface
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+
+package router
+
+import (
+    "errors"
+    "net"
+    "testing"
+
+    "github.com/dualface/go-gbc/gbc"
+    "github.com/dualface/go-gbc/gbc/impl"
+    "github.com/golang/protobuf/proto"
+    "github.com/golang/protobuf/ptypes/wrappers"
+)
+
+func newTestMessage(c gbc.Connection, mainCmdId uint16, subCmdId uint16, data []byte) *impl.CommandMessage {
+    m := impl.NewCommandMessageFromData(mainCmdId, subCmdId, impl.CommandMessageProtobufType, data)
+    m.SetConnection(c)
+    return m
+}
+
+func TestRouterMatch(t *testing.T) {
+    r := NewRouter()
+    var got []string
+    r.Handle(1, 1, func(m *impl.CommandMessage) error {
+        got = append(got, "1:1")
+        return nil
+    })
+    r.HandleMain(1, func(m *impl.CommandMessage) error {
+        got = append(got, "1:*")
+        return nil
+    })
+    if err := r.Handle(1, 1, func(m *impl.CommandMessage) error { return nil }); err == nil {
+        t.Fatal("registered handler twice")
+    }
+
+    // exact command first, then main command
+    for _, sub := range []uint16{1, 2} {
+        if err := r.Route(newTestMessage(nil, 1, sub, nil)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if len(got) != 2 || got[0] != "1:1" || got[1] != "1:*" {
+        t.Fatalf("routed to %v", got)
+    }
+
+    if err := r.Route(newTestMessage(nil, 2, 1, nil)); err == nil {
+        t.Fatal("routed command without handler")
+    }
+    fallback := errors.New("fallback")
+    r.Fallback(func(m *impl.CommandMessage) error { return fallback })
+    if err := r.Route(newTestMessage(nil, 2, 1, nil)); err != fallback {
+        t.Fatalf("expected fallback, got %v", err)
+    }
+}
+
+func TestRouterMiddleware(t *testing.T) {
+    r := NewRouter()
+    r.Use(Recover(), Auth(SessionHas("uid"), impl.CommandId{MainCmdId: 11, SubCmdId: impl.AnySubCmdId}))
+
+    var login string
+    err := r.HandleProto(11, 1, func(m *impl.CommandMessage, pb *wrappers.StringValue) error {
+        login = pb.Value
+        m.Connection().Session().Set("uid", 1)
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := r.HandleProto(11, 2, func(m *impl.CommandMessage, s string) error { return nil }); err == nil {
+        t.Fatal("registered handler without proto message")
+    }
+    r.Handle(12, 1, func(m *impl.CommandMessage) error { return nil })
+    r.Handle(12, 2, func(m *impl.CommandMessage) error { panic("boom") })
+
+    local, remote := net.Pipe()
+    defer remote.Close()
+    c := impl.NewBasicConnection(local, nil)
+
+    if err := r.Route(newTestMessage(c, 12, 1, nil)); err != gbc.ErrUnauthorized {
+        t.Fatalf("expected unauthorized, got %v", err)
+    }
+    b, _ := proto.Marshal(&wrappers.StringValue{Value: "hello"})
+    if err := r.Route(newTestMessage(c, 11, 1, b)); err != nil {
+        t.Fatal(err)
+    }
+    if login != "hello" {
+        t.Fatalf("unmarshaled %q", login)
+    }
+    if err := r.Route(newTestMessage(c, 12, 1, nil)); err != nil {
+        t.Fatal(err)
+    }
+
+    // panic of handler is returned as error
+    if err := r.Route(newTestMessage(c, 12, 2, nil)); err == nil {
+        t.Fatal("panic not recovered")
+    }
+}
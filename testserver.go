@@ -43,8 +43,8 @@ const (
 func main() {
     rand.Seed(time.Now().Unix())
 
-    // a worker pool, max 3 concurrence jobs
-    handler := impl.NewConcurrenceMessageHandler(3, func(m gbc.RawMessage) error {
+    // a worker pool, max 3 concurrence jobs, messages from same connection are handled in order
+    handler := impl.NewKeyedConcurrenceMessageHandler(3, 0, impl.ConnectionMessageKey, func(m gbc.RawMessage) error {
         fmt.Printf("%+v\n", m)
         time.Sleep(time.Second / 2)
         return nil